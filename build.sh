@@ -8,5 +8,5 @@ go vet ./goben
 which golint >/dev/null && golint ./goben
 #which staticcheck >/dev/null && staticcheck ./goben
 
-go test ./goben
+go test ./...
 CGO_ENABLED=0 go install -v ./goben
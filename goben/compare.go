@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/b3g00d/goben/lib"
+)
+
+// runCompare implements 'goben compare' and returns the process exit code:
+// 0 no regression, 1 regression found, 2 usage or input error.
+func runCompare(args []string) int {
+	var cfg lib.CompareConfig
+	var units string
+
+	fs := flag.NewFlagSet("compare", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: goben compare [options] baseline.yaml run.yaml [run.yaml...]\n")
+		fs.PrintDefaults()
+	}
+	fs.Float64Var(&cfg.Threshold, "threshold", 5, "percent drop below baseline flagged as regression")
+	fs.StringVar(&cfg.Chart, "chart", "", "output filename for rendering all runs in one PNG chart")
+	fs.StringVar(&units, "units", "", "rate unit for the comparison (defaults to baseline unit)")
+
+	fs.Parse(args)
+
+	cfg.Files = fs.Args()
+
+	if units != "" {
+		var errUnit error
+		cfg.Unit, errUnit = lib.ParseUnit(units)
+		if errUnit != nil {
+			log.Printf("compare: %v", errUnit)
+			return 2
+		}
+	}
+
+	regressions, errCompare := lib.Compare(cfg, os.Stdout)
+	if errCompare != nil {
+		log.Printf("compare: %v", errCompare)
+		return 2
+	}
+
+	if regressions > 0 {
+		log.Printf("compare: %d regression(s) beyond %.1f%% threshold", regressions, cfg.Threshold)
+		return 1
+	}
+
+	log.Printf("compare: no regression beyond %.1f%% threshold", cfg.Threshold)
+	return 0
+}
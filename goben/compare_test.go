@@ -0,0 +1,43 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRunCompareExitCode(t *testing.T) {
+	dir, errDir := ioutil.TempDir("", "goben-compare")
+	if errDir != nil {
+		t.Fatal(errDir)
+	}
+	defer os.RemoveAll(dir)
+
+	base := filepath.Join(dir, "base.yaml")
+	run := filepath.Join(dir, "run.json")
+	if err := ioutil.WriteFile(base, []byte("unit: Mbps\ninputstats: {samples: 2, average: 100}\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(run, []byte(`{"Unit": "Kbps", "InputStats": {"Samples": 2, "Average": 90000}}`), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	table := []struct {
+		args []string
+		code int
+	}{
+		{[]string{base, run}, 1},                        // -10% input average
+		{[]string{"-threshold", "10", base, run}, 0},    // at the threshold
+		{[]string{run, base}, 0},                        // +11%
+		{[]string{base}, 2},                             // one file
+		{[]string{base, filepath.Join(dir, "x")}, 2},    // missing file
+		{[]string{"-units", "bogus", base, run}, 2},     // bad unit
+		{[]string{"-units", "Gbps", base, run, run}, 1}, // any run regressing
+	}
+	for _, d := range table {
+		if code := runCompare(d.args); code != d.code {
+			t.Errorf("compare %v: exit code=%d wanted=%d", d.args, code, d.code)
+		}
+	}
+}
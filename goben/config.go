@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/b3g00d/goben/lib"
+	"gopkg.in/yaml.v2"
+)
+
+// profilesKey holds named profiles in a config file.
+// Every other top-level key is a flag name applied to all profiles.
+const profilesKey = "profiles"
+
+// readConfigFile loads a YAML or JSON config file into a generic map.
+func readConfigFile(filename string) (map[string]interface{}, error) {
+	b, errRead := ioutil.ReadFile(filename)
+	if errRead != nil {
+		return nil, errRead
+	}
+
+	values := map[string]interface{}{}
+
+	if strings.ToLower(filepath.Ext(filename)) == ".json" {
+		if errJSON := json.Unmarshal(b, &values); errJSON != nil {
+			return nil, fmt.Errorf("config %s: %v", filename, errJSON)
+		}
+		return values, nil
+	}
+
+	if errYAML := yaml.Unmarshal(b, &values); errYAML != nil {
+		return nil, fmt.Errorf("config %s: %v", filename, errYAML)
+	}
+
+	return values, nil
+}
+
+// applyConfigFile sets flags from the config file, then from the named profile.
+// Flags given on the command line are left untouched.
+func applyConfigFile(fs *flag.FlagSet, filename, profile string) error {
+	if filename == "" {
+		if profile != "" {
+			return fmt.Errorf("profile %q requires -config", profile)
+		}
+		return nil
+	}
+
+	values, errRead := readConfigFile(filename)
+	if errRead != nil {
+		return errRead
+	}
+
+	profiles, errProfiles := toStringMap(values[profilesKey])
+	if errProfiles != nil {
+		return fmt.Errorf("config %s: %s: %v", filename, profilesKey, errProfiles)
+	}
+	delete(values, profilesKey)
+
+	cli := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		cli[f.Name] = true
+	})
+
+	log.Printf("config: loading %s", filename)
+	if errApply := applyValues(fs, cli, values); errApply != nil {
+		return fmt.Errorf("config %s: %v", filename, errApply)
+	}
+
+	if profile == "" {
+		return nil
+	}
+
+	p, found := profiles[profile]
+	if !found {
+		var names []string
+		for name := range profiles {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		return fmt.Errorf("config %s: profile %q not found, available: %q", filename, profile, names)
+	}
+
+	profileValues, errProfile := toStringMap(p)
+	if errProfile != nil {
+		return fmt.Errorf("config %s: profile %s: %v", filename, profile, errProfile)
+	}
+
+	log.Printf("config: applying profile %s", profile)
+	if errApply := applyValues(fs, cli, profileValues); errApply != nil {
+		return fmt.Errorf("config %s: profile %s: %v", filename, profile, errApply)
+	}
+
+	return nil
+}
+
+func applyValues(fs *flag.FlagSet, cli map[string]bool, values map[string]interface{}) error {
+	var names []string
+	for name := range values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if name == "config" || name == "profile" {
+			return fmt.Errorf("key %q is not allowed in config file", name)
+		}
+		if fs.Lookup(name) == nil {
+			if isFlag(name) {
+				log.Printf("config: ignoring %q: not a %s flag", name, fs.Name())
+				continue
+			}
+			return fmt.Errorf("unknown flag: %q", name)
+		}
+		if cli[name] {
+			continue // command line wins
+		}
+		if hl, isList := fs.Lookup(name).Value.(interface{ Reset() }); isList {
+			hl.Reset() // profile replaces file-level list
+		}
+		if errSet := fs.Set(name, flagValue(values[name])); errSet != nil {
+			return fmt.Errorf("flag %q: %v", name, errSet)
+		}
+	}
+
+	return nil
+}
+
+// isFlag checks name against the full flag set,
+// so that one config file can be shared by server and client.
+func isFlag(name string) bool {
+	fs := flag.NewFlagSet("all", flag.ContinueOnError)
+	addFlags(fs, &lib.Config{})
+	return fs.Lookup(name) != nil
+}
+
+// flagValue formats a decoded YAML/JSON value as flag text.
+// Lists are joined with commas, as expected by -hosts and -listeners.
+func flagValue(v interface{}) string {
+	switch t := v.(type) {
+	case []interface{}:
+		items := make([]string, 0, len(t))
+		for _, i := range t {
+			items = append(items, flagValue(i))
+		}
+		return strings.Join(items, ",")
+	case float64:
+		return strconv.FormatFloat(t, 'f', -1, 64)
+	case nil:
+		return ""
+	}
+	return fmt.Sprint(v)
+}
+
+// toStringMap accepts both YAML and JSON decoded maps.
+func toStringMap(v interface{}) (map[string]interface{}, error) {
+	switch t := v.(type) {
+	case nil:
+		return map[string]interface{}{}, nil
+	case map[string]interface{}:
+		return t, nil
+	case map[interface{}]interface{}:
+		m := make(map[string]interface{}, len(t))
+		for k, val := range t {
+			m[fmt.Sprint(k)] = val
+		}
+		return m, nil
+	}
+	return nil, fmt.Errorf("expecting a map, got %T", v)
+}
+
+// logEffectiveConfig prints every flag value with its origin.
+func logEffectiveConfig(fs *flag.FlagSet) {
+	set := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		set[f.Name] = true
+	})
+
+	fs.VisitAll(func(f *flag.Flag) {
+		origin := "default"
+		if set[f.Name] {
+			origin = "set"
+		}
+		value := f.Value.String()
+		if f.Name == "secret" && value != "" {
+			value = "********"
+		}
+		log.Printf("config: -%s=%q (%s)", f.Name, value, origin)
+	})
+}
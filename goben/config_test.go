@@ -0,0 +1,92 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/b3g00d/goben/lib"
+)
+
+const testConfig = `
+connections: 2
+hosts: [h1, h2]
+maxSpeed: 100
+profiles:
+  lte:
+    hosts: [lte-gw]
+    maxSpeed: 0.8
+    totalDuration: 30s
+`
+
+func TestApplyConfigFile(t *testing.T) {
+	dir, errDir := ioutil.TempDir("", "goben-config")
+	if errDir != nil {
+		t.Fatal(errDir)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "goben.yaml")
+	if err := ioutil.WriteFile(filename, []byte(testConfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var app lib.Config
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	addFlags(fs, &app)
+	if err := fs.Parse([]string{"-connections", "4"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := applyConfigFile(fs, filename, "lte"); err != nil {
+		t.Fatalf("applyConfigFile: %v", err)
+	}
+
+	if app.Connections != 4 {
+		t.Errorf("connections: result=%d wanted=4 (command line wins)", app.Connections)
+	}
+	if len(app.Hosts) != 1 || app.Hosts[0] != "lte-gw" {
+		t.Errorf("hosts: result=%q wanted=[lte-gw] (profile wins)", app.Hosts)
+	}
+	if app.Opt.MaxSpeed != 0.8 {
+		t.Errorf("maxSpeed: result=%v wanted=0.8", app.Opt.MaxSpeed)
+	}
+	if app.TotalDuration != "30s" {
+		t.Errorf("totalDuration: result=%s wanted=30s", app.TotalDuration)
+	}
+
+	if err := applyConfigFile(fs, filename, "missing"); err == nil {
+		t.Errorf("missing profile: expected error")
+	}
+}
+
+func TestHostArgsOverConfigFile(t *testing.T) {
+	dir, errDir := ioutil.TempDir("", "goben-config")
+	if errDir != nil {
+		t.Fatal(errDir)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "goben.yaml")
+	if err := ioutil.WriteFile(filename, []byte(testConfig), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	var app lib.Config
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	addFlags(fs, &app)
+	if err := fs.Parse([]string{"h3", "h4"}); err != nil {
+		t.Fatal(err)
+	}
+	addHostArgs(fs)
+
+	if err := applyConfigFile(fs, filename, "lte"); err != nil {
+		t.Fatalf("applyConfigFile: %v", err)
+	}
+
+	if len(app.Hosts) != 2 || app.Hosts[0] != "h3" || app.Hosts[1] != "h4" {
+		t.Errorf("hosts: result=%q wanted=[h3 h4] (arguments win)", app.Hosts)
+	}
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/b3g00d/goben/lib"
+)
+
+// agentRun is the outcome of one agent in a coordinated test.
+type agentRun struct {
+	Agent    string
+	Hosts    []string
+	Response lib.RunResponse
+	Error    string `json:",omitempty"` // control API failure
+}
+
+// mergedReport sums the results of all agents.
+type mergedReport struct {
+	Unit      string
+	StartAt   time.Time
+	Attempted int
+	Connected int
+	Input     float64 // sum of agent aggregate input averages
+	Output    float64 // sum of agent aggregate output averages
+	Expected  int64
+	Lost      int64
+	MaxRTT    time.Duration
+	Agents    []agentRun
+}
+
+// runController implements 'goben controller': ask several agents, which are
+// goben servers started with -control, to run the same client test at the
+// same instant, then merge their results.
+func runController(args []string) int {
+	app := lib.Config{}
+
+	fs := flag.NewFlagSet("controller", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: goben controller -agents agent[=host+host...],... [client options] [hosts...]\n")
+		fs.PrintDefaults()
+	}
+	addCommonFlags(fs, &app)
+	addClientFlags(fs, &app)
+	agents := fs.String("agents", "", "comma-separated list of agent control addresses: host[:port]\nappend =host1+host2 to give an agent its own target hosts")
+	startDelay := fs.Duration("startDelay", 2*time.Second, "delay before the common start, allowing every agent to receive the test")
+	report := fs.String("report", "", "output filename for the merged JSON report")
+	configFile, profile := addConfigFlags(fs)
+
+	fs.Parse(args)
+
+	addHostArgs(fs)
+
+	if errConfig := applyConfigFile(fs, *configFile, *profile); errConfig != nil {
+		log.Printf("controller: %v", errConfig)
+		return 2
+	}
+
+	if errSetup := setupClientConfig(fs, &app); errSetup != nil {
+		log.Printf("controller: %v", errSetup)
+		return 2
+	}
+
+	if *agents == "" {
+		log.Printf("controller: missing -agents")
+		return 2
+	}
+
+	// results are collected by the controller, agents do not write files
+	app.Chart = ""
+	app.Export = ""
+	app.Csv = ""
+	app.JSON = ""
+	app.ASCII = false
+
+	var runs []agentRun
+	for _, entry := range strings.Split(*agents, ",") {
+		ar := agentRun{Agent: entry, Hosts: app.Hosts}
+		if i := strings.IndexByte(entry, '='); i >= 0 {
+			ar.Agent = entry[:i]
+			ar.Hosts = nil
+			for _, h := range strings.Split(entry[i+1:], "+") {
+				if h != "" {
+					ar.Hosts = append(ar.Hosts, h)
+				}
+			}
+		}
+		if len(ar.Hosts) == 0 {
+			log.Printf("controller: agent %s: missing hosts", ar.Agent)
+			return 2
+		}
+		runs = append(runs, ar)
+	}
+
+	startAt := time.Now().Add(*startDelay)
+
+	log.Printf("controller: %d agent(s), start at %v", len(runs), startAt)
+
+	var wg sync.WaitGroup
+	for i := range runs {
+		wg.Add(1)
+		go func(ar *agentRun) {
+			defer wg.Done()
+			cfg := app
+			cfg.Hosts = ar.Hosts
+			log.Printf("controller: agent %s: hosts=%q", ar.Agent, ar.Hosts)
+			var errRun error
+			ar.Response, errRun = lib.RunAgent(ar.Agent, lib.RunRequest{StartAt: startAt, Config: cfg})
+			if errRun != nil {
+				ar.Error = errRun.Error()
+				log.Printf("controller: agent %s: %v", ar.Agent, errRun)
+			}
+		}(&runs[i])
+	}
+	wg.Wait()
+
+	merged := mergeAgents(app.Unit.String(), startAt, runs)
+
+	writeControllerTable(os.Stdout, merged)
+
+	if *report != "" {
+		log.Printf("controller: exporting merged JSON report to: %s", *report)
+		if err := writePlanFile(*report, func(w io.Writer) error {
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "  ")
+			return enc.Encode(merged)
+		}); err != nil {
+			log.Printf("controller: export JSON: %s: %v", *report, err)
+		}
+	}
+
+	return agentsExitCode(runs)
+}
+
+func mergeAgents(unit string, startAt time.Time, runs []agentRun) mergedReport {
+	m := mergedReport{Unit: unit, StartAt: startAt, Agents: runs}
+	for _, ar := range runs {
+		r := ar.Response.Result
+		m.Attempted += r.Attempted
+		m.Connected += r.Connected
+		m.Input += r.Input.Average
+		m.Output += r.Output.Average
+		m.Expected += r.Expected
+		m.Lost += r.Lost
+		if r.MaxRTT > m.MaxRTT {
+			m.MaxRTT = r.MaxRTT
+		}
+	}
+	return m
+}
+
+// agentsExitCode is the worst client exit code among agents.
+// An agent unreachable through the control API counts as a setup failure.
+func agentsExitCode(runs []agentRun) int {
+	exitCode := 0
+	for _, ar := range runs {
+		code := 0
+		switch {
+		case ar.Error != "":
+			code = 2
+		case len(ar.Response.Failures) > 0:
+			code = 1
+		case ar.Response.Error != "":
+			code = 2
+		}
+		if code > exitCode {
+			exitCode = code
+		}
+	}
+	return exitCode
+}
+
+func writeControllerTable(w io.Writer, m mergedReport) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "AGENT\tHOSTS\tCONNECTED\tINPUT\tOUTPUT\tLOSS%\tRTT\tUNIT\tERROR")
+	for _, ar := range m.Agents {
+		r := ar.Response.Result
+		e := ar.Error
+		if e == "" {
+			e = ar.Response.Error
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%d/%d\t%.3f\t%.3f\t%.3f\t%v\t%s\t%s\n",
+			ar.Agent, strings.Join(ar.Hosts, "+"), r.Connected, r.Attempted,
+			r.Input.Average, r.Output.Average, r.Loss(), r.MaxRTT, m.Unit, e)
+	}
+	total := lib.Result{Expected: m.Expected, Lost: m.Lost}
+	fmt.Fprintf(tw, "%s\t%s\t%d/%d\t%.3f\t%.3f\t%.3f\t%v\t%s\t%s\n",
+		"TOTAL", "", m.Connected, m.Attempted, m.Input, m.Output, total.Loss(), m.MaxRTT, m.Unit, "")
+	tw.Flush()
+}
@@ -4,6 +4,7 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"os"
 	"runtime"
 	"strconv"
 	"strings"
@@ -31,83 +32,434 @@ func main() {
 
 	log.Printf("goben version " + version + " runtime " + runtime.Version() + " GOMAXPROCS=" + strconv.Itoa(runtime.GOMAXPROCS(0)) + " OS=" + runtime.GOOS + " arch=" + runtime.GOARCH)
 
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "server":
+			os.Exit(runServer(os.Args[2:]))
+		case "client":
+			os.Exit(runClient(os.Args[2:]))
+		case "compare":
+			os.Exit(runCompare(os.Args[2:]))
+		case "plan":
+			os.Exit(runPlan(os.Args[2:]))
+		case "controller":
+			os.Exit(runController(os.Args[2:]))
+		case "selftest":
+			os.Exit(runSelftest(os.Args[2:]))
+		}
+	}
+
+	os.Exit(runLegacy(os.Args[1:]))
+}
+
+const subcommandUsage = `usage: goben <command> [options]
+
+commands:
+  server     run the test server
+  client     run a test against one or more servers
+  compare    compare exported results
+  plan       run a matrix of client tests
+  controller run a client test on several agents at once
+  selftest   run a short client test against a local server
+
+Run 'goben <command> -h' for command options.
+Without a command, all options are accepted: goben runs as client when
+-hosts is given, otherwise as server.
+
+`
+
+// runLegacy keeps the original flag-only invocation, inferring the mode from -hosts.
+func runLegacy(args []string) int {
+	app := lib.Config{}
+
+	fs := flag.CommandLine
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), subcommandUsage)
+		fmt.Fprintf(fs.Output(), "Usage of goben:\n")
+		fs.PrintDefaults()
+	}
+	addFlags(fs, &app)
+	configFile, profile := addConfigFlags(fs)
+
+	fs.Parse(args)
+
+	if errConfig := applyConfigFile(fs, *configFile, *profile); errConfig != nil {
+		log.Panicf("%v", errConfig)
+	}
+
+	if errSetup := setupConfig(fs, &app); errSetup != nil {
+		log.Panicf("%v", errSetup)
+	}
+
+	logEffectiveConfig(fs)
+
+	log.Printf("connections=%d defaultPort=%s listeners=%q hosts=%q",
+		app.Connections, app.DefaultPort, app.Listeners, app.Hosts)
+	log.Printf("reportInterval=%s totalDuration=%s omit=%s", app.Opt.ReportInterval, app.Opt.TotalDuration, app.Opt.Omit)
+
+	if len(app.Hosts) == 0 {
+		log.Printf("server mode (use -hosts to switch to client mode)")
+		lib.BuildServer(&app)
+		return 0
+	}
+
+	return startClient(&app)
+}
+
+// runServer implements 'goben server'.
+func runServer(args []string) int {
 	app := lib.Config{}
 
-	flag.Var(&app.Hosts, "hosts", "comma-separated list of hosts\nyou may append an optional port to every host: host[:port]")
-	flag.Var(&app.Listeners, "listeners", "comma-separated list of listen addresses\nyou may prepend an optional host to every port: [host]:port")
-	flag.StringVar(&app.DefaultPort, "defaultPort", ":8080", "default port")
-	flag.IntVar(&app.Connections, "connections", 1, "number of parallel connections")
-	flag.StringVar(&app.ReportInterval, "reportInterval", "2s", "periodic report interval\nunspecified time unit defaults to second")
-	flag.StringVar(&app.TotalDuration, "totalDuration", "10s", "test total duration\nunspecified time unit defaults to second")
-	flag.IntVar(&app.Opt.TCPReadSize, "tcpReadSize", 1000000, "TCP read buffer size in bytes")
-	flag.IntVar(&app.Opt.TCPWriteSize, "tcpWriteSize", 1000000, "TCP write buffer size in bytes")
-	flag.IntVar(&app.Opt.UDPReadSize, "udpReadSize", 64000, "UDP read buffer size in bytes")
-	flag.IntVar(&app.Opt.UDPWriteSize, "udpWriteSize", 64000, "UDP write buffer size in bytes")
-	flag.BoolVar(&app.PassiveClient, "passiveClient", false, "suppress client writes")
-	flag.BoolVar(&app.Opt.PassiveServer, "passiveServer", false, "suppress server writes")
-	flag.Float64Var(&app.Opt.MaxSpeed, "maxSpeed", 0, "bandwidth limit in mbps (0 means unlimited)")
-	flag.BoolVar(&app.UDP, "udp", false, "run client in UDP mode")
-	flag.StringVar(&app.Chart, "chart", "", "output filename for rendering chart on client\n'%d' is parallel connection index to host\n'%s' is hostname:port\nexample: -chart chart-%d-%s.png")
-	flag.StringVar(&app.Export, "export", "", "output filename for YAML exporting test results on client\n'%d' is parallel connection index to host\n'%s' is hostname:port\nexample: -export export-%d-%s.yaml")
-	flag.StringVar(&app.Csv, "csv", "", "output filename for CSV exporting test results on client\n'%d' is parallel connection index to host\n'%s' is hostname:port\nexample: -csv export-%d-%s.csv")
-	flag.BoolVar(&app.ASCII, "ascii", true, "plot ascii chart")
-	flag.StringVar(&app.TLSKey, "key", "key.pem", "TLS key file")
-	flag.StringVar(&app.TLSCert, "cert", "cert.pem", "TLS cert file")
-	flag.BoolVar(&app.TLS, "tls", true, "set to false to disable TLS")
-	flag.StringVar(&app.LocalAddr, "localAddr", "", "bind specific local address:port\nexample: -localAddr 127.0.0.1:2000")
-
-	flag.Parse()
+	fs := flag.NewFlagSet("server", flag.ExitOnError)
+	addCommonFlags(fs, &app)
+	addServerFlags(fs, &app)
+	configFile, profile := addConfigFlags(fs)
+
+	fs.Parse(args)
+
+	if fs.NArg() > 0 {
+		log.Printf("server: unexpected arguments: %q", fs.Args())
+		return 2
+	}
+
+	if errConfig := applyConfigFile(fs, *configFile, *profile); errConfig != nil {
+		log.Printf("server: %v", errConfig)
+		return 2
+	}
+
+	if errSetup := setupServerConfig(&app); errSetup != nil {
+		log.Printf("server: %v", errSetup)
+		return 2
+	}
+
+	logEffectiveConfig(fs)
+
+	log.Printf("server mode: defaultPort=%s listeners=%q control=%q", app.DefaultPort, app.Listeners, app.Control)
+	lib.BuildServer(&app)
+
+	return 0
+}
+
+// runClient implements 'goben client'.
+func runClient(args []string) int {
+	app := lib.Config{}
+
+	fs := flag.NewFlagSet("client", flag.ExitOnError)
+	addCommonFlags(fs, &app)
+	addClientFlags(fs, &app)
+	configFile, profile := addConfigFlags(fs)
+
+	fs.Parse(args)
+
+	addHostArgs(fs)
+
+	if errConfig := applyConfigFile(fs, *configFile, *profile); errConfig != nil {
+		log.Printf("client: %v", errConfig)
+		return 2
+	}
+
+	if errSetup := setupClientConfig(fs, &app); errSetup != nil {
+		log.Printf("client: %v", errSetup)
+		return 2
+	}
+
+	if len(app.Hosts) == 0 {
+		log.Printf("client: missing hosts: use -hosts or list hosts as arguments")
+		return 2
+	}
+
+	logEffectiveConfig(fs)
+
+	log.Printf("connections=%d defaultPort=%s hosts=%q", app.Connections, app.DefaultPort, app.Hosts)
+	log.Printf("reportInterval=%s totalDuration=%s omit=%s", app.Opt.ReportInterval, app.Opt.TotalDuration, app.Opt.Omit)
+
+	return startClient(&app)
+}
+
+func startClient(app *lib.Config) int {
+	var proto string
+	if app.UDP {
+		proto = "udp"
+	} else {
+		proto = "tcp"
+	}
+
+	log.Printf("client mode, %s protocol", proto)
+	_, errClient := lib.BuildClient(app)
+	return clientExitCode(errClient)
+}
+
+// addFlags defines every command-line flag on fs, bound to app.
+func addFlags(fs *flag.FlagSet, app *lib.Config) {
+	addCommonFlags(fs, app)
+	addServerFlags(fs, app)
+	addClientFlags(fs, app)
+}
+
+func addConfigFlags(fs *flag.FlagSet) (configFile, profile *string) {
+	configFile = fs.String("config", "", "YAML or JSON file with flag values, overridden by command-line flags")
+	profile = fs.String("profile", "", "named profile to apply from the -config file")
+	return
+}
+
+// addCommonFlags defines flags used by both server and client.
+func addCommonFlags(fs *flag.FlagSet, app *lib.Config) {
+	fs.StringVar(&app.DefaultPort, "defaultPort", ":8080", "default port")
+	fs.IntVar(&app.Opt.UDPReadSize, "udpReadSize", 64000, "UDP read buffer size in bytes")
+	fs.BoolVar(&app.TLS, "tls", true, "set to false to disable TLS")
+	fs.StringVar(&app.Secret, "secret", "", "shared secret for client authentication, defaults to $"+secretEnv+"\nservers with a secret refuse clients without the same secret")
+	fs.StringVar(&app.Units, "units", "Mbps", "rate unit for reports, charts and exports\nbits: bps Kbps Mbps Gbps, bytes: Bps KBps MBps GBps\nIEC prefixes: Kibps Mibps Gibps KiBps MiBps GiBps")
+}
+
+// addServerFlags defines server-only flags.
+func addServerFlags(fs *flag.FlagSet, app *lib.Config) {
+	fs.Var(&app.Listeners, "listeners", "comma-separated list of listen addresses\nyou may prepend an optional host to every port: [host]:port")
+	fs.StringVar(&app.TLSKey, "key", "key.pem", "TLS key file")
+	fs.StringVar(&app.TLSCert, "cert", "cert.pem", "TLS cert file")
+	fs.IntVar(&app.Limits.MaxSessions, "maxSessions", 0, "maximum concurrent test sessions (0 means unlimited)")
+	fs.IntVar(&app.Limits.MaxBufferSize, "maxBufferSize", 0, "refuse tests requesting larger read or write sizes, in bytes (0 means unlimited)")
+	fs.DurationVar(&app.Limits.MaxDuration, "maxDuration", 0, "refuse tests longer than this, including omit (0 means unlimited)")
+	fs.Float64Var(&app.Limits.MaxSpeed, "maxSessionSpeed", 0, "bandwidth limit in mbps per session and direction, capping client -maxSpeed (0 means unlimited)")
+	fs.StringVar(&app.Control, "control", "", "listen address for the HTTP control API, which lets a controller run client tests from this server\nan address without host listens on localhost, other addresses require -secret\nrequests carry a one-time HMAC token of the secret, bound to method, path and time, so tokens cannot be replayed\nthe API is plain HTTP: anyone on the path can read tests and results, or alter a request in flight\nexample: -control :9090")
+}
+
+// addClientFlags defines client-only flags.
+func addClientFlags(fs *flag.FlagSet, app *lib.Config) {
+	fs.Var(&app.Hosts, "hosts", "comma-separated list of hosts\nyou may append an optional port to every host: host[:port]\nper-host options: host[:port]?connections=8&maxSpeed=500&udp=true")
+	fs.IntVar(&app.Connections, "connections", 1, "number of parallel connections")
+	fs.StringVar(&app.ReportInterval, "reportInterval", "2s", "periodic report interval\nunspecified time unit defaults to second")
+	fs.StringVar(&app.TotalDuration, "totalDuration", "10s", "test total duration\nunspecified time unit defaults to second")
+	fs.StringVar(&app.Omit, "omit", "0s", "warm-up period excluded from results, added before totalDuration\nunspecified time unit defaults to second")
+	fs.Int64Var(&app.Opt.TotalBytes, "totalBytes", 0, "stop each direction after transferring this many bytes (0 means unlimited)\ntotalDuration becomes a timeout, disabled unless given explicitly")
+	fs.Int64Var(&app.Opt.TotalPackets, "totalPackets", 0, "stop each direction after this many UDP datagrams or TCP writes (0 means unlimited)\ntotalDuration becomes a timeout, disabled unless given explicitly")
+	fs.IntVar(&app.Opt.TCPReadSize, "tcpReadSize", 1000000, "TCP read buffer size in bytes")
+	fs.IntVar(&app.Opt.TCPWriteSize, "tcpWriteSize", 1000000, "TCP write buffer size in bytes")
+	fs.IntVar(&app.Opt.UDPWriteSize, "udpWriteSize", 64000, "UDP write buffer size in bytes")
+	fs.BoolVar(&app.PassiveClient, "passiveClient", false, "suppress client writes")
+	fs.BoolVar(&app.Opt.PassiveServer, "passiveServer", false, "suppress server writes")
+	fs.Float64Var(&app.Opt.MaxSpeed, "maxSpeed", 0, "bandwidth limit in mbps (0 means unlimited)")
+	fs.BoolVar(&app.UDP, "udp", false, "run client in UDP mode")
+	fs.StringVar(&app.Wire, "wire", lib.WireGob, "handshake message format: gob or json, see PROTOCOL.md\nservers accept both, servers before protocol version 1 only gob")
+	fs.StringVar(&app.Chart, "chart", "", "output filename for rendering chart on client\n'%d' is parallel connection index to host\n'%s' is hostname:port\nexample: -chart chart-%d-%s.png")
+	fs.StringVar(&app.Export, "export", "", "output filename for YAML exporting test results on client\n'%d' is parallel connection index to host\n'%s' is hostname:port\nexample: -export export-%d-%s.yaml")
+	fs.StringVar(&app.Csv, "csv", "", "output filename for CSV exporting test results on client\n'%d' is parallel connection index to host\n'%s' is hostname:port\nexample: -csv export-%d-%s.csv")
+	fs.StringVar(&app.JSON, "json", "", "output filename for JSON exporting test results on client\n'%d' is parallel connection index to host\n'%s' is hostname:port\nexample: -json export-%d-%s.json")
+	fs.BoolVar(&app.ASCII, "ascii", true, "plot ascii chart")
+	fs.StringVar(&app.LocalAddr, "localAddr", "", "bind specific local address:port\nexample: -localAddr 127.0.0.1:2000")
+	fs.DurationVar(&app.ConnectTimeout, "connectTimeout", 10*time.Second, "timeout for dialing and handshake of each connection (0 means none)")
+	fs.IntVar(&app.ConnectRetries, "connectRetries", 0, "dial retries after a failed connection attempt")
+	fs.DurationVar(&app.ConnectRetryDelay, "connectRetryDelay", time.Second, "delay between dial retries")
+	fs.BoolVar(&app.ControlConn, "controlConn", true, "open a control connection per host, for start, stop, server intervals and results\nset to false to use only data connections, as with servers before protocol version 2")
+	fs.StringVar(&app.Opt.Payload, "payload", lib.PayloadRandom, "test data written by client and server: random, zeros, compressible or file\nservers before protocol version 2 always send random data")
+	fs.Float64Var(&app.Opt.PayloadRatio, "payloadRatio", 2, "approximate compression ratio of -payload compressible, e.g. 2 for 2:1")
+	fs.StringVar(&app.PayloadFile, "payloadFile", "", fmt.Sprintf("file repeated as test data with -payload file, at most %d bytes", lib.MaxPayloadFile))
+	fs.BoolVar(&app.Opt.ZeroCopy, "zeroCopy", false, "on Linux, send TCP data with sendfile instead of write calls, on both sides\nnot with TLS, UDP or -verify")
+	fs.BoolVar(&app.Opt.Verify, "verify", false, "send patterned data and check every block received, on both sides\ncorrupted blocks fail the test")
+	fs.BoolVar(&app.Opt.SyncStart, "syncStart", false, "start transferring on all connections at the same instant, after every handshake")
+	fs.DurationVar(&app.RampUp, "rampUp", 0, "start one connection every rampUp instead of all at once (0 disables)\neach step with a constant connection count is reported")
+	fs.DurationVar(&app.RampDown, "rampDown", 0, "after totalDuration, stop one connection every rampDown (0 disables)")
+	fs.Float64Var(&app.Thresholds.MinRate, "minRate", 0, "fail unless the aggregate rate of each active direction reaches this value, in -units (0 disables)")
+	fs.Float64Var(&app.Thresholds.MaxLoss, "maxLoss", 0, "fail if UDP datagram loss exceeds this percent, 0 fails on any loss (unset disables)")
+	fs.DurationVar(&app.Thresholds.MaxRTT, "maxRTT", 0, "fail if a TCP handshake round-trip exceeds this duration (0 disables)")
+	fs.BoolVar(&app.Thresholds.RequireAll, "requireAll", false, "fail unless all connections succeed")
+}
+
+// setupConfig validates flag values parsed into app and fills derived fields.
+func setupConfig(fs *flag.FlagSet, app *lib.Config) error {
+	if errServer := setupServerConfig(app); errServer != nil {
+		return errServer
+	}
+	return setupClientConfig(fs, app)
+}
+
+// secretEnv holds the default for -secret, keeping it out of command lines.
+const secretEnv = "GOBEN_SECRET"
+
+func setupSecret(app *lib.Config) {
+	if app.Secret == "" {
+		app.Secret = os.Getenv(secretEnv)
+	}
+}
+
+func setupServerConfig(app *lib.Config) error {
+	setupSecret(app)
+
+	l := app.Limits
+	if l.MaxSessions < 0 || l.MaxBufferSize < 0 || l.MaxDuration < 0 || l.MaxSpeed < 0 {
+		return fmt.Errorf("bad limits: must not be negative")
+	}
+
+	var errUnit error
+	app.Unit, errUnit = lib.ParseUnit(app.Units)
+	if errUnit != nil {
+		return fmt.Errorf("bad units: %v", errUnit)
+	}
+
+	if len(app.Listeners) == 0 {
+		app.Listeners = []string{app.DefaultPort}
+	}
+
+	if app.Control != "" {
+		var errControl error
+		app.Control, errControl = lib.ControlAddr(app.Control, app.Secret)
+		if errControl != nil {
+			return fmt.Errorf("bad control: %v", errControl)
+		}
+	}
+
+	return nil
+}
+
+func setupClientConfig(fs *flag.FlagSet, app *lib.Config) error {
+	setupSecret(app)
 
 	if errChart := badExportFilename("-chart", app.Chart); errChart != nil {
-		log.Panicf("%s", errChart.Error())
+		return errChart
 	}
 
 	if errExport := badExportFilename("-export", app.Export); errExport != nil {
-		log.Panicf("%s", errExport.Error())
+		return errExport
 	}
 
 	if errCsv := badExportFilename("-csv", app.Csv); errCsv != nil {
-		log.Panicf("%s", errCsv.Error())
+		return errCsv
+	}
+
+	if errJSON := badExportFilename("-json", app.JSON); errJSON != nil {
+		return errJSON
 	}
 
+	var errUnit error
+	app.Unit, errUnit = lib.ParseUnit(app.Units)
+	if errUnit != nil {
+		return fmt.Errorf("bad units: %v", errUnit)
+	}
+
+	if app.Connections < 1 {
+		return fmt.Errorf("bad connections: %d: must be at least 1", app.Connections)
+	}
+
+	// -maxLoss 0 fails on any loss, while the default skips the check
+	app.Thresholds.CheckLoss = flagIsSet(fs, "maxLoss")
+
 	app.ReportInterval = defaultTimeUnit(app.ReportInterval)
 	app.TotalDuration = defaultTimeUnit(app.TotalDuration)
+	app.Omit = defaultTimeUnit(app.Omit)
 
 	var errInterval error
 	app.Opt.ReportInterval, errInterval = time.ParseDuration(app.ReportInterval)
 	if errInterval != nil {
-		log.Panicf("bad reportInterval: %q: %v", app.ReportInterval, errInterval)
+		return fmt.Errorf("bad reportInterval: %q: %v", app.ReportInterval, errInterval)
 	}
 
 	var errDuration error
 	app.Opt.TotalDuration, errDuration = time.ParseDuration(app.TotalDuration)
 	if errDuration != nil {
-		log.Panicf("bad totalDuration: %q: %v", app.TotalDuration, errDuration)
+		return fmt.Errorf("bad totalDuration: %q: %v", app.TotalDuration, errDuration)
 	}
 
-	if len(app.Listeners) == 0 {
-		app.Listeners = []string{app.DefaultPort}
+	if app.Opt.TotalBytes > 0 || app.Opt.TotalPackets > 0 {
+		if !flagIsSet(fs, "totalDuration") {
+			app.Opt.TotalDuration = 0 // no timeout
+		}
+		log.Printf("transfer limit: totalBytes=%d totalPackets=%d timeout=%v (0 means none, UDP ends when idle)", app.Opt.TotalBytes, app.Opt.TotalPackets, app.Opt.TotalDuration)
 	}
 
-	log.Printf("connections=%d defaultPort=%s listeners=%q hosts=%q",
-		app.Connections, app.DefaultPort, app.Listeners, app.Hosts)
-	log.Printf("reportInterval=%s totalDuration=%s", app.Opt.ReportInterval, app.Opt.TotalDuration)
+	if app.Wire != lib.WireGob && app.Wire != lib.WireJSON {
+		return fmt.Errorf("bad wire: %q: must be %s or %s", app.Wire, lib.WireGob, lib.WireJSON)
+	}
 
-	if len(app.Hosts) == 0 {
-		log.Printf("server mode (use -hosts to switch to client mode)")
-		lib.BuildServer(&app)
-		return
+	if errPayload := setupPayload(app); errPayload != nil {
+		return errPayload
 	}
 
-	var proto string
-	if app.UDP {
-		proto = "udp"
-	} else {
-		proto = "tcp"
+	if app.Opt.ZeroCopy && app.Opt.Verify {
+		return fmt.Errorf("bad zeroCopy: can not be combined with verify")
 	}
 
-	log.Printf("client mode, %s protocol", proto)
-	lib.BuildClient(&app)
+	if app.ConnectRetries < 0 {
+		return fmt.Errorf("bad connectRetries: %d: must not be negative", app.ConnectRetries)
+	}
+
+	if app.RampUp < 0 || app.RampDown < 0 {
+		return fmt.Errorf("bad ramp: rampUp=%v rampDown=%v: must not be negative", app.RampUp, app.RampDown)
+	}
+
+	if (app.RampUp > 0 || app.RampDown > 0) && app.Opt.SyncStart {
+		return fmt.Errorf("bad ramp: rampUp and rampDown can not be combined with syncStart")
+	}
+
+	if (app.RampUp > 0 || app.RampDown > 0) && (app.Opt.TotalBytes > 0 || app.Opt.TotalPackets > 0) {
+		return fmt.Errorf("bad ramp: rampUp and rampDown require a time-based test, not totalBytes or totalPackets")
+	}
+
+	var errOmit error
+	app.Opt.Omit, errOmit = time.ParseDuration(app.Omit)
+	if errOmit != nil {
+		return fmt.Errorf("bad omit: %q: %v", app.Omit, errOmit)
+	}
+
+	return nil
+}
+
+// setupPayload checks the payload options and loads the payload file.
+func setupPayload(app *lib.Config) error {
+	switch app.Opt.Payload {
+	case lib.PayloadRandom, lib.PayloadZeros:
+	case lib.PayloadCompressible:
+		if app.Opt.PayloadRatio < 1 {
+			return fmt.Errorf("bad payloadRatio: %v: must be at least 1", app.Opt.PayloadRatio)
+		}
+	case lib.PayloadFile:
+		if app.PayloadFile == "" {
+			return fmt.Errorf("bad payload: %s requires -payloadFile", lib.PayloadFile)
+		}
+		data, errRead := lib.ReadPayloadFile(app.PayloadFile)
+		if errRead != nil {
+			return fmt.Errorf("bad payloadFile: %v", errRead)
+		}
+		app.Opt.PayloadData = data
+	default:
+		return fmt.Errorf("bad payload: %q: must be %s, %s, %s or %s", app.Opt.Payload, lib.PayloadRandom, lib.PayloadZeros, lib.PayloadCompressible, lib.PayloadFile)
+	}
+
+	if app.Opt.Payload != lib.PayloadRandom && app.Opt.Verify {
+		return fmt.Errorf("bad payload: %s can not be combined with verify", app.Opt.Payload)
+	}
+
+	return nil
+}
+
+// clientExitCode maps the client outcome to the process exit code:
+// 0 success, 1 threshold failed, 2 no connection succeeded.
+func clientExitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	log.Printf("client: %v", err)
+	if _, isThreshold := err.(*lib.ThresholdError); isThreshold {
+		return 1
+	}
+	return 2
+}
+
+// addHostArgs adds the hosts given as arguments, goben client host1 host2,
+// through the -hosts flag, so that they win over config files like -hosts.
+func addHostArgs(fs *flag.FlagSet) {
+	for _, h := range fs.Args() {
+		fs.Set("hosts", h)
+	}
+}
+
+// flagIsSet reports whether the flag was given on the command line or config file
+func flagIsSet(fs *flag.FlagSet, name string) bool {
+	var found bool
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			found = true
+		}
+	})
+	return found
 }
 
 // append "s" (second) to time string
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/b3g00d/goben/lib"
+)
+
+// planStep is one combination of matrix parameters and its outcome.
+type planStep struct {
+	Params map[string]string
+	Result lib.Result
+	Error  string `json:",omitempty"`
+}
+
+// runPlan implements 'goben plan': run every combination of the plan matrix
+// sequentially and report all results together. It returns the worst
+// client exit code among all runs.
+func runPlan(args []string) int {
+	fs := flag.NewFlagSet("plan", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: goben plan [client options] plan.yaml\n")
+		fs.PrintDefaults()
+	}
+	addClientFlags(fs, &lib.Config{}) // only for usage and validation of base flags
+	addCommonFlags(fs, &lib.Config{})
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return 2
+	}
+	planFile := fs.Arg(0)
+	baseArgs := args[:len(args)-1]
+
+	values, errRead := readConfigFile(planFile)
+	if errRead != nil {
+		log.Printf("plan: %v", errRead)
+		return 2
+	}
+
+	base, errBase := toStringMap(values["base"])
+	if errBase != nil {
+		log.Printf("plan: %s: base: %v", planFile, errBase)
+		return 2
+	}
+	matrix, errMatrix := toStringMap(values["matrix"])
+	if errMatrix != nil {
+		log.Printf("plan: %s: matrix: %v", planFile, errMatrix)
+		return 2
+	}
+	output, errOutput := toStringMap(values["output"])
+	if errOutput != nil {
+		log.Printf("plan: %s: output: %v", planFile, errOutput)
+		return 2
+	}
+
+	keys, combos, errCombos := planCombinations(matrix)
+	if errCombos != nil {
+		log.Printf("plan: %s: matrix: %v", planFile, errCombos)
+		return 2
+	}
+
+	log.Printf("plan: %s: %d combination(s) of %q", planFile, len(combos), keys)
+
+	var steps []planStep
+	exitCode := 0
+
+	for i, combo := range combos {
+		log.Printf("plan: run %d/%d: %v", i+1, len(combos), combo)
+		step := planStep{Params: combo}
+
+		app, errSetup := planConfig(baseArgs, base, combo)
+		if errSetup != nil {
+			step.Error = errSetup.Error()
+			log.Printf("plan: run %d/%d: %v", i+1, len(combos), errSetup)
+			steps = append(steps, step)
+			exitCode = 2
+			continue
+		}
+
+		var errClient error
+		step.Result, errClient = lib.BuildClient(app)
+		if errClient != nil {
+			step.Error = errClient.Error()
+		}
+		if code := clientExitCode(errClient); code > exitCode {
+			exitCode = code
+		}
+		steps = append(steps, step)
+	}
+
+	writePlanTable(os.Stdout, keys, steps)
+
+	if filename := flagValue(output["csv"]); filename != "" {
+		log.Printf("plan: exporting CSV plan results to: %s", filename)
+		if err := writePlanFile(filename, func(w io.Writer) error { return writePlanCsv(w, keys, steps) }); err != nil {
+			log.Printf("plan: export CSV: %s: %v", filename, err)
+		}
+	}
+
+	if filename := flagValue(output["json"]); filename != "" {
+		log.Printf("plan: exporting JSON plan results to: %s", filename)
+		if err := writePlanFile(filename, func(w io.Writer) error {
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "  ")
+			return enc.Encode(steps)
+		}); err != nil {
+			log.Printf("plan: export JSON: %s: %v", filename, err)
+		}
+	}
+
+	return exitCode
+}
+
+// planCombinations expands the matrix into the cartesian product of its values.
+// Keys are sorted so runs are ordered predictably. An empty list is an error,
+// since it would leave no run at all.
+func planCombinations(matrix map[string]interface{}) ([]string, []map[string]string, error) {
+	var keys []string
+	for k := range matrix {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	combos := []map[string]string{{}}
+
+	for _, k := range keys {
+		var choices []string
+		if list, isList := matrix[k].([]interface{}); isList {
+			if len(list) == 0 {
+				return nil, nil, fmt.Errorf("key %q: empty list of values", k)
+			}
+			for _, v := range list {
+				choices = append(choices, flagValue(v))
+			}
+		} else {
+			choices = []string{flagValue(matrix[k])}
+		}
+
+		var next []map[string]string
+		for _, c := range combos {
+			for _, v := range choices {
+				m := make(map[string]string, len(c)+1)
+				for ck, cv := range c {
+					m[ck] = cv
+				}
+				m[k] = v
+				next = append(next, m)
+			}
+		}
+		combos = next
+	}
+
+	return keys, combos, nil
+}
+
+// planConfig builds the client config for one combination:
+// command-line flags, then plan base values, then matrix values.
+func planConfig(baseArgs []string, base map[string]interface{}, combo map[string]string) (*lib.Config, error) {
+	app := &lib.Config{}
+
+	fs := flag.NewFlagSet("plan", flag.ContinueOnError)
+	addCommonFlags(fs, app)
+	addClientFlags(fs, app)
+
+	if errParse := fs.Parse(baseArgs); errParse != nil {
+		return nil, errParse
+	}
+
+	cli := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		cli[f.Name] = true
+	})
+
+	if errBase := applyValues(fs, cli, base); errBase != nil {
+		return nil, fmt.Errorf("base: %v", errBase)
+	}
+
+	for k, v := range combo {
+		f := fs.Lookup(k)
+		if f == nil {
+			return nil, fmt.Errorf("matrix: unknown flag: %q", k)
+		}
+		if hl, isList := f.Value.(interface{ Reset() }); isList {
+			hl.Reset()
+		}
+		if errSet := fs.Set(k, v); errSet != nil {
+			return nil, fmt.Errorf("matrix: flag %q: %v", k, errSet)
+		}
+	}
+
+	if errSetup := setupClientConfig(fs, app); errSetup != nil {
+		return nil, errSetup
+	}
+
+	if len(app.Hosts) == 0 {
+		return nil, fmt.Errorf("plan requires hosts")
+	}
+
+	return app, nil
+}
+
+var planColumns = []string{"CONNECTED", "INPUT", "INPUT_P50", "OUTPUT", "OUTPUT_P50", "LOSS%", "RTT", "UNIT", "ERROR"}
+
+func planRow(keys []string, step planStep) []string {
+	r := step.Result
+	row := make([]string, 0, len(keys)+len(planColumns))
+	for _, k := range keys {
+		row = append(row, step.Params[k])
+	}
+	return append(row,
+		fmt.Sprintf("%d/%d", r.Connected, r.Attempted),
+		fmt.Sprintf("%.3f", r.Input.Average),
+		fmt.Sprintf("%.3f", r.Input.P50),
+		fmt.Sprintf("%.3f", r.Output.Average),
+		fmt.Sprintf("%.3f", r.Output.P50),
+		fmt.Sprintf("%.3f", r.Loss()),
+		r.MaxRTT.String(),
+		r.Unit,
+		step.Error,
+	)
+}
+
+func writePlanTable(w io.Writer, keys []string, steps []planStep) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(append(append([]string{}, keys...), planColumns...), "\t"))
+	for _, s := range steps {
+		fmt.Fprintln(tw, strings.Join(planRow(keys, s), "\t"))
+	}
+	tw.Flush()
+}
+
+func writePlanCsv(w io.Writer, keys []string, steps []planStep) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write(append(append([]string{}, keys...), planColumns...)); err != nil {
+		return err
+	}
+	for _, s := range steps {
+		if err := cw.Write(planRow(keys, s)); err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func writePlanFile(filename string, write func(w io.Writer) error) error {
+	out, errCreate := os.Create(filename)
+	if errCreate != nil {
+		return errCreate
+	}
+	if errWrite := write(out); errWrite != nil {
+		out.Close()
+		return errWrite
+	}
+	return out.Close()
+}
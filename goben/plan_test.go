@@ -0,0 +1,98 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestPlanCombinations(t *testing.T) {
+	matrix := map[string]interface{}{
+		"udp":         []interface{}{false, true},
+		"connections": []interface{}{1, 2, 4},
+		"maxSpeed":    10,
+	}
+
+	keys, combos, err := planCombinations(matrix)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(keys) != "[connections maxSpeed udp]" {
+		t.Errorf("keys: %v", keys)
+	}
+	var runs []string
+	for _, c := range combos {
+		runs = append(runs, c["connections"]+"/"+c["maxSpeed"]+"/"+c["udp"])
+	}
+	want := "[1/10/false 1/10/true 2/10/false 2/10/true 4/10/false 4/10/true]"
+	if fmt.Sprint(runs) != want {
+		t.Errorf("combinations: result=%v wanted=%s", runs, want)
+	}
+
+	if _, combos, _ := planCombinations(nil); len(combos) != 1 || len(combos[0]) != 0 {
+		t.Errorf("empty matrix: combinations=%v wanted one run of base", combos)
+	}
+
+	matrix["connections"] = []interface{}{}
+	if _, _, err := planCombinations(matrix); err == nil {
+		t.Errorf("empty list: expected error")
+	}
+}
+
+func TestPlanConfig(t *testing.T) {
+	base := map[string]interface{}{
+		"hosts":       []interface{}{"h1", "h2"},
+		"connections": 2,
+		"maxSpeed":    100,
+		"udp":         true,
+	}
+	cli := []string{"-connections", "4", "-totalDuration", "3s"}
+
+	app, err := planConfig(cli, base, map[string]string{"maxSpeed": "5"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if app.Connections != 4 {
+		t.Errorf("command line over base: connections=%d wanted=4", app.Connections)
+	}
+	if app.Opt.MaxSpeed != 5 {
+		t.Errorf("matrix over base: maxSpeed=%v wanted=5", app.Opt.MaxSpeed)
+	}
+	if !app.UDP || fmt.Sprint(app.Hosts) != "[h1 h2]" || app.Opt.TotalDuration.String() != "3s" {
+		t.Errorf("base and command line: udp=%v hosts=%v totalDuration=%v", app.UDP, app.Hosts, app.Opt.TotalDuration)
+	}
+
+	app, err = planConfig(cli, base, map[string]string{"connections": "8", "hosts": "h3"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if app.Connections != 8 || fmt.Sprint(app.Hosts) != "[h3]" {
+		t.Errorf("matrix over command line: connections=%d hosts=%v wanted=8 [h3]", app.Connections, app.Hosts)
+	}
+
+	if _, err := planConfig(cli, base, map[string]string{"bogus": "1"}); err == nil {
+		t.Errorf("unknown matrix flag: expected error")
+	}
+	if _, err := planConfig(cli, map[string]interface{}{"connections": 2}, nil); err == nil {
+		t.Errorf("no hosts: expected error")
+	}
+}
+
+func TestRunPlanEmptyList(t *testing.T) {
+	dir, errDir := ioutil.TempDir("", "goben-plan")
+	if errDir != nil {
+		t.Fatal(errDir)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := filepath.Join(dir, "plan.yaml")
+	plan := "base:\n  hosts: [localhost]\nmatrix:\n  connections: []\n"
+	if err := ioutil.WriteFile(filename, []byte(plan), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if code := runPlan([]string{filename}); code != 2 {
+		t.Errorf("empty matrix list: exit code=%d wanted=2", code)
+	}
+}
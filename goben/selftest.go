@@ -0,0 +1,166 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"github.com/b3g00d/goben/lib"
+)
+
+// runSelftest implements 'goben selftest': start a server on a free
+// loopback port, then run a short TCP and a short UDP client test against it.
+// It returns the worst client exit code.
+func runSelftest(args []string) int {
+	fs := flag.NewFlagSet("selftest", flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: goben selftest [client options]\n")
+		fs.PrintDefaults()
+	}
+	app := lib.Config{}
+	addCommonFlags(fs, &app)
+	addClientFlags(fs, &app)
+	shortDefault(fs, "totalDuration", "3s")
+	shortDefault(fs, "reportInterval", "1s")
+	fs.Parse(args)
+
+	if fs.NArg() > 0 || len(app.Hosts) > 0 {
+		log.Printf("selftest: hosts are not accepted, selftest runs against a local server")
+		return 2
+	}
+
+	port, errPort := freePort()
+	if errPort != nil {
+		log.Printf("selftest: %v", errPort)
+		return 2
+	}
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+
+	// the server takes the flags shared with the client
+	srv := lib.Config{
+		Listeners:   []string{addr},
+		DefaultPort: app.DefaultPort,
+		TLS:         false,
+		Secret:      app.Secret,
+		Units:       app.Units,
+	}
+	srv.Opt.UDPReadSize = app.Opt.UDPReadSize
+	if errSetup := setupServerConfig(&srv); errSetup != nil {
+		log.Printf("selftest: %v", errSetup)
+		return 2
+	}
+
+	log.Printf("selftest: starting server on %s", addr)
+	go lib.BuildServer(&srv)
+
+	if errWait := waitListener(addr, 5*time.Second); errWait != nil {
+		log.Printf("selftest: %v", errWait)
+		return 2
+	}
+
+	app.Hosts = []string{addr}
+	app.TLS = false
+	app.Thresholds.RequireAll = true
+
+	if errSetup := setupClientConfig(fs, &app); errSetup != nil {
+		log.Printf("selftest: %v", errSetup)
+		return 2
+	}
+
+	// a quick check may be too short for charts of at least two samples
+	if app.ASCII && app.Opt.TotalDuration < 2*app.Opt.ReportInterval {
+		log.Printf("selftest: ASCII charts disabled: totalDuration %v gives less than two %v report intervals", app.Opt.TotalDuration, app.Opt.ReportInterval)
+		app.ASCII = false
+	}
+
+	exitCode := 0
+
+	for _, udp := range []bool{false, true} {
+		app.UDP = udp
+		log.Printf("selftest: udp=%v", udp)
+		result, errClient := lib.BuildClient(&app)
+		code := clientExitCode(errClient)
+		if errClient == nil {
+			if failures := checkTransfer(&app, result); len(failures) > 0 {
+				for _, f := range failures {
+					log.Printf("selftest: udp=%v FAIL: %s", udp, f)
+				}
+				code = 1
+			}
+		}
+		log.Printf("selftest: udp=%v exit code: %d", udp, code)
+		if code > exitCode {
+			exitCode = code
+		}
+	}
+
+	if exitCode == 0 {
+		log.Printf("selftest: PASS")
+	} else {
+		log.Printf("selftest: FAIL")
+	}
+
+	return exitCode
+}
+
+// checkTransfer lists the active directions of result in which nothing was
+// received, and the byte counts of client and server not matching.
+// The bytes received by the server are known through the control connection,
+// which the local server always accepts.
+func checkTransfer(app *lib.Config, result lib.Result) []string {
+	var failures []string
+	for _, hr := range result.Hosts {
+		if !app.PassiveClient {
+			switch {
+			case !app.ControlConn:
+				log.Printf("selftest: host %s: SKIP: upload not checked without control connection", hr.Host)
+			case hr.ServerSessions == 0:
+				failures = append(failures, fmt.Sprintf("host %s: upload: server reported no session", hr.Host))
+			case hr.ServerInputBytes == 0:
+				failures = append(failures, fmt.Sprintf("host %s: upload: server received no bytes", hr.Host))
+			}
+		}
+		if !app.Opt.PassiveServer && hr.InputBytes == 0 {
+			failures = append(failures, fmt.Sprintf("host %s: download: client received no bytes", hr.Host))
+		}
+	}
+	if result.ByteMismatches > 0 {
+		failures = append(failures, fmt.Sprintf("%d direction(s) with client and server byte counts not matching", result.ByteMismatches))
+	}
+	return failures
+}
+
+// shortDefault replaces the default value of a flag before parsing.
+func shortDefault(fs *flag.FlagSet, name, value string) {
+	f := fs.Lookup(name)
+	f.Value.Set(value)
+	f.DefValue = value
+}
+
+func freePort() (int, error) {
+	listener, errListen := net.Listen("tcp", "127.0.0.1:0")
+	if errListen != nil {
+		return 0, errListen
+	}
+	port := listener.Addr().(*net.TCPAddr).Port
+	listener.Close()
+	return port, nil
+}
+
+// waitListener polls addr until the server accepts TCP connections.
+func waitListener(addr string, timeout time.Duration) error {
+	begin := time.Now()
+	for {
+		conn, errDial := net.Dial("tcp", addr)
+		if errDial == nil {
+			conn.Close()
+			return nil
+		}
+		if time.Since(begin) > timeout {
+			return fmt.Errorf("server not ready: %s: %v", addr, errDial)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
@@ -0,0 +1,19 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSelftestShortDuration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("runs a local server and client")
+	}
+	for _, args := range [][]string{
+		{"-totalDuration", "1s", "-reportInterval", "1s"},
+		{"-totalDuration", "2s", "-reportInterval", "1s"}, // charts on, one sample per direction
+	} {
+		if code := runSelftest(args); code != 0 {
+			t.Errorf("selftest %q: exit code=%d wanted=0", args, code)
+		}
+	}
+}
@@ -0,0 +1,72 @@
+package lib
+
+import (
+	"fmt"
+	"log"
+)
+
+// byteCheck compares the bytes sent by one side of a direction to the bytes
+// received by the other side. Over TCP and TLS they must match exactly, UDP
+// may lose datagrams but never receive more than was sent.
+// It returns a description and whether the counts are inconsistent.
+func byteCheck(sender, receiver string, sent, received int64, udp bool) (string, bool) {
+	desc := fmt.Sprintf("%s sent %d bytes, %s received %d bytes", sender, sent, receiver, received)
+
+	missing := sent - received
+	switch {
+	case missing == 0:
+		return desc + ": exact", false
+	case missing < 0:
+		return fmt.Sprintf("%s: MISMATCH: %d bytes received but never sent", desc, -missing), true
+	case udp:
+		return fmt.Sprintf("%s: %d bytes (%.3f%%) lost", desc, missing, 100*float64(missing)/float64(sent)), false
+	}
+	return fmt.Sprintf("%s: MISMATCH: %d bytes (%.3f%%) never received", desc, missing, 100*float64(missing)/float64(sent)), true
+}
+
+// transferred adds the bytes received and sent by a client connection to host.
+func (r *clientRun) transferred(host string, udp bool, input, output int64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	hr := r.hosts[host]
+	hr.InputBytes += input
+	hr.OutputBytes += output
+	r.udp[host] = udp
+}
+
+// corrupted adds the blocks found corrupted by a client connection to host.
+func (r *clientRun) corrupted(host string, blocks int64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.hosts[host].CorruptedBlocks += blocks
+	r.result.CorruptedBlocks += blocks
+}
+
+// checkBytes compares client and server byte counts in each direction,
+// for hosts which reported server results. It logs the comparison and
+// returns the number of inconsistent directions.
+func (r *clientRun) checkBytes() int {
+	var mismatches int
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for i := range r.result.Hosts {
+		hr := &r.result.Hosts[i]
+		if hr.ServerSessions == 0 {
+			continue // legacy server, or control connection disabled
+		}
+
+		upload, badUpload := byteCheck("client", "server", hr.OutputBytes, hr.ServerInputBytes, r.udp[hr.Host])
+		download, badDownload := byteCheck("server", "client", hr.ServerOutputBytes, hr.InputBytes, r.udp[hr.Host])
+
+		log.Printf("open: host %s: upload: %s", hr.Host, upload)
+		log.Printf("open: host %s: download: %s", hr.Host, download)
+
+		if badUpload {
+			mismatches++
+		}
+		if badDownload {
+			mismatches++
+		}
+	}
+	return mismatches
+}
@@ -0,0 +1,120 @@
+package lib
+
+import (
+	"encoding/csv"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestByteCheck(t *testing.T) {
+	cases := []struct {
+		sent, received int64
+		udp            bool
+		mismatch       bool
+	}{
+		{1000, 1000, false, false},
+		{1000, 900, false, true},
+		{1000, 1100, false, true},
+		{1000, 900, true, false},
+		{1000, 1100, true, true},
+		{0, 0, false, false},
+	}
+	for _, c := range cases {
+		desc, mismatch := byteCheck("client", "server", c.sent, c.received, c.udp)
+		if mismatch != c.mismatch {
+			t.Errorf("byteCheck: sent=%d received=%d udp=%v: expected mismatch=%v, got %v: %s", c.sent, c.received, c.udp, c.mismatch, mismatch, desc)
+		}
+	}
+}
+
+func TestOmitExcluded(t *testing.T) {
+	unit, _ := ParseUnit("Mbps")
+	omit := 100 * time.Millisecond
+	interval := 20 * time.Millisecond
+	const slow = 100 // Mbps, far below the warm-up rate
+
+	acc := newAccount(time.Now(), unit, omit)
+	var stat ChartData
+
+	// warm-up at about 1600 Mbps
+	var warmBytes int64
+	for !acc.omitDone {
+		acc.update(1000000, interval, "test", "input", "recv/s", &stat)
+		warmBytes += 1000000
+		time.Sleep(5 * time.Millisecond)
+	}
+	omitEnd := acc.start
+	if len(stat.YValues) != 0 {
+		t.Errorf("warm-up intervals recorded: %v", stat.YValues)
+	}
+
+	// then at about 1.6 Mbps
+	var testBytes int64
+	for time.Since(omitEnd) < 300*time.Millisecond {
+		acc.update(1000, interval, "test", "input", "recv/s", &stat)
+		testBytes += 1000
+		time.Sleep(5 * time.Millisecond)
+	}
+
+	var agg aggregate
+	s := acc.average("test", "input", "recv/s", &agg)
+
+	if s.Omitted < 10*s.Average {
+		t.Errorf("omitted: %.3f Mbps average: %.3f Mbps: warm-up rate not reported", s.Omitted, s.Average)
+	}
+	if s.Average > slow || s.Max > slow || s.Mean > slow {
+		t.Errorf("warm-up in totals: average=%.3f max=%.3f mean=%.3f", s.Average, s.Max, s.Mean)
+	}
+	if s.Samples == 0 || s.Samples != len(stat.YValues) {
+		t.Errorf("samples=%d chart points=%d", s.Samples, len(stat.YValues))
+	}
+	for i, x := range stat.XValues {
+		if x.Before(omitEnd) || stat.YValues[i] > slow {
+			t.Errorf("chart point %d: %v %.3f during warm-up", i, x.Sub(omitEnd), stat.YValues[i])
+		}
+	}
+	if s.Bytes != warmBytes+testBytes {
+		t.Errorf("bytes=%d wanted=%d including warm-up", s.Bytes, warmBytes+testBytes)
+	}
+
+	aggStats := agg.stats()
+	if aggStats.Average != s.Average || aggStats.Omitted != s.Omitted || aggStats.Max != s.Max {
+		t.Errorf("aggregate: %v wanted %v", aggStats, s)
+	}
+
+	dir, errDir := ioutil.TempDir("", "goben-omit")
+	if errDir != nil {
+		t.Fatal(errDir)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "omit.csv")
+	if err := exportCsv(filename, &ExportInfo{Unit: "Mbps", Input: stat, InputStats: s}); err != nil {
+		t.Fatal(err)
+	}
+	f, errOpen := os.Open(filename)
+	if errOpen != nil {
+		t.Fatal(errOpen)
+	}
+	defer f.Close()
+	rows, errCsv := csv.NewReader(f).ReadAll()
+	if errCsv != nil {
+		t.Fatal(errCsv)
+	}
+	var inputRows int
+	for _, row := range rows {
+		if row[Dir] != "input" {
+			continue
+		}
+		inputRows++
+		if rate, _ := strconv.ParseFloat(row[Rate], 64); rate > slow {
+			t.Errorf("export row during warm-up: %v", row)
+		}
+	}
+	if inputRows != len(stat.YValues) {
+		t.Errorf("export rows=%d wanted=%d", inputRows, len(stat.YValues))
+	}
+}
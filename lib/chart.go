@@ -7,7 +7,7 @@ import (
 	"github.com/wcharczuk/go-chart"
 )
 
-func chartRender(filename string, input *ChartData, output *ChartData) error {
+func chartRender(filename, unit string, input *ChartData, output *ChartData) error {
 
 	log.Printf("chartRender: input data points:  %d/%d", len(input.XValues), len(input.YValues))
 	log.Printf("chartRender: output data points: %d/%d", len(output.XValues), len(output.YValues))
@@ -28,7 +28,7 @@ func chartRender(filename string, input *ChartData, output *ChartData) error {
 			ValueFormatter: chart.TimeMinuteValueFormatter,
 		},
 		YAxis: chart.YAxis{
-			Name: "Mbps",
+			Name: unit,
 			Style: chart.Style{
 				Show: true, //enables / displays the y-axis
 			},
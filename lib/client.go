@@ -1,36 +1,431 @@
 package lib
 
 import (
-	"bytes"
 	"crypto/tls"
-	"encoding/gob"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"math/rand"
 	"net"
+	"os"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
-func open(app *Config) (bool, int64, int64) {
-	var proto string
-	if app.UDP {
-		proto = "udp"
-	} else {
-		proto = "tcp"
+// clientRun collects connection outcomes across all client connections.
+type clientRun struct {
+	aggReader aggregate
+	aggWriter aggregate
+	mutex     sync.Mutex
+	result    Result
+	hosts     map[string]*HostResult
+	udp       map[string]bool // hosts tested over UDP
+
+	syncStart bool           // connections wait for each other before transferring
+	barrier   sync.WaitGroup // connections yet to reach the start barrier
+	startOnce sync.Once
+	start     time.Time
+	onStart   func() // called once, when the barrier opens
+}
+
+func newClientRun(hosts []*Config) *clientRun {
+	run := &clientRun{hosts: map[string]*HostResult{}, udp: map[string]bool{}}
+	for _, hc := range hosts {
+		h := hc.Hosts[0]
+		if _, found := run.hosts[h]; !found {
+			run.result.Hosts = append(run.result.Hosts, HostResult{Host: h})
+			run.hosts[h] = nil
+		}
+	}
+	for i := range run.result.Hosts {
+		run.hosts[run.result.Hosts[i].Host] = &run.result.Hosts[i]
+	}
+	return run
+}
+
+func (r *clientRun) attempted(host string) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.result.Attempted++
+	r.hosts[host].Attempted++
+}
+
+// connected records a successful handshake, rtt is zero when not measured.
+func (r *clientRun) connected(host string, rtt time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.result.Connected++
+	r.hosts[host].Connected++
+	if rtt > r.result.MaxRTT {
+		r.result.MaxRTT = rtt
+	}
+}
+
+// rejected records a UDP test rejected by the server after the connection
+// was counted, since UDP clients without authentication get no ack.
+func (r *clientRun) rejected(host string, err error) {
+	r.mutex.Lock()
+	r.result.Connected--
+	r.hosts[host].Connected--
+	r.mutex.Unlock()
+	r.failed(host, err)
+}
+
+// failed records a dial or handshake error for host.
+func (r *clientRun) failed(host string, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	hr := r.hosts[host]
+	if hr.Errors == nil {
+		hr.Errors = map[string]int{}
+	}
+	hr.Errors[errorClass(err)]++
+}
+
+// errorClass drops addresses from network errors, so that
+// failures of several connections to a host are counted together.
+func errorClass(err error) string {
+	if op, isOp := err.(*net.OpError); isOp {
+		if sys, isSys := op.Err.(*os.SyscallError); isSys {
+			return fmt.Sprintf("%s: %v", op.Op, sys.Err)
+		}
+		return fmt.Sprintf("%s: %v", op.Op, op.Err)
+	}
+	return err.Error()
+}
+
+// retryable reports whether a dial error may go away on retry: unknown
+// hosts and malformed addresses do not.
+func retryable(err error) bool {
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) {
+		return !dnsErr.IsNotFound
+	}
+	var addrErr *net.AddrError
+	if errors.As(err, &addrErr) {
+		return false
+	}
+	var netErr net.UnknownNetworkError
+	return !errors.As(err, &netErr)
+}
+
+// arrive releases the start barrier slot of a connection that failed.
+func (r *clientRun) arrive() {
+	if r.syncStart {
+		r.barrier.Done()
+	}
+}
+
+// waitStart blocks until every connection has either reached the barrier
+// or failed, then returns the start time common to all connections.
+func (r *clientRun) waitStart() time.Time {
+	r.barrier.Done()
+	r.barrier.Wait()
+	r.startOnce.Do(func() {
+		r.start = time.Now()
+		if r.onStart != nil {
+			r.onStart()
+		}
+	})
+	return r.start
+}
+
+func (r *clientRun) startOffset(offset time.Duration) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if offset > r.result.MaxStartOffset {
+		r.result.MaxStartOffset = offset
+	}
+}
+
+// logHosts prints the per-host connection summary.
+func (r *clientRun) logHosts() {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	for _, hr := range r.result.Hosts {
+		log.Printf("open: host %s: %d/%d connected", hr.Host, hr.Connected, hr.Attempted)
+		if hr.ServerSessions > 0 {
+			log.Printf("open: host %s: server: %d session(s), received %d bytes, sent %d bytes", hr.Host, hr.ServerSessions, hr.ServerInputBytes, hr.ServerOutputBytes)
+		}
+		if hr.CorruptedBlocks > 0 || hr.ServerCorruptedBlocks > 0 {
+			log.Printf("open: host %s: corrupted blocks: received by client %d, by server %d", hr.Host, hr.CorruptedBlocks, hr.ServerCorruptedBlocks)
+		}
+		var errs []string
+		for e := range hr.Errors {
+			errs = append(errs, e)
+		}
+		sort.Strings(errs)
+		for _, e := range errs {
+			log.Printf("open: host %s: %d error(s): %s", hr.Host, hr.Errors[e], e)
+		}
+	}
+}
+
+// serverResults records the server results of a test with host.
+func (r *clientRun) serverResults(host string, results []SessionResult) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	hr := r.hosts[host]
+	for _, sr := range results {
+		hr.ServerSessions++
+		hr.ServerInputBytes += sr.Session.InputBytes
+		hr.ServerOutputBytes += sr.Session.OutputBytes
+		hr.ServerCorruptedBlocks += sr.CorruptedBlocks
+		r.result.CorruptedBlocks += sr.CorruptedBlocks
+	}
+}
+
+func (r *clientRun) addLoss(expected, lost int64) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.result.Expected += expected
+	r.result.Lost += lost
+}
+
+// clientSlot is one connection to open, in dial order.
+type clientSlot struct {
+	hc *Config
+	c  int // connection index within the host
+}
+
+func open(app *Config, hosts []*Config) Result {
+	var wg sync.WaitGroup
+
+	var dialWg sync.WaitGroup
+
+	run := newClientRun(hosts)
+
+	log.Printf("hosts: %s", app.Hosts)
+
+	var slots []clientSlot
+	for _, hc := range hosts {
+		log.Printf("open: %s: connections=%d maxSpeed=%v tcpWriteSize=%d udpWriteSize=%d", hc.Hosts[0], hc.Connections, hc.Opt.MaxSpeed, hc.Opt.TCPWriteSize, hc.Opt.UDPWriteSize)
+		for i := 0; i < hc.Connections; i++ {
+			slots = append(slots, clientSlot{hc: hc, c: i})
+		}
+	}
+
+	if app.Opt.SyncStart {
+		run.syncStart = true
+		run.barrier.Add(len(slots))
+	}
+
+	ctls := openControls(hosts)
+	run.onStart = func() {
+		for _, cc := range ctls {
+			if errStart := cc.send(ctlMsg{Type: ctlStart}); errStart != nil {
+				log.Printf("open: %s: control start: %v", cc.host, errStart)
+			}
+		}
+	}
+
+	begin := time.Now()
+	user0, system0, cpuOK := cpuTime()
+
+	var steps chan []RampStep
+	allDone := make(chan struct{})
+
+	if app.rampEnabled() {
+		log.Printf("open: ramp: connections=%d rampUp=%v rampDown=%v", len(slots), app.RampUp, app.RampDown)
+		steps = make(chan []RampStep, 1)
+		schedule := rampSchedule(app, len(slots))
+		go func() {
+			steps <- rampMonitor(begin, schedule, run, app.Unit, allDone)
+		}()
+	}
+
+	for k, s := range slots {
+		hc := s.hc
+
+		if app.rampEnabled() {
+			time.Sleep(time.Until(begin.Add(time.Duration(k) * app.RampUp)))
+			rc := *hc
+			rc.Opt.TotalDuration = rampDuration(app, k, len(slots))
+			hc = &rc
+		}
+
+		// spawnClient adds to wg before dialWg is done, so wg.Wait below
+		// covers every connection
+		dialWg.Add(1)
+		go func(hc *Config, c int) {
+			defer dialWg.Done()
+			openConnection(hc, &wg, c, run)
+		}(hc, s.c)
+	}
+
+	dialWg.Wait()
+	wg.Wait()
+	close(allDone)
+
+	finishControls(ctls, run)
+
+	if steps != nil {
+		run.result.Steps = <-steps
+		logRampPeak(run.result.Steps, app.Unit)
+	}
+
+	log.Printf("aggregate reading: %.3f %s %.0f recv/s", run.aggReader.Rate, app.Unit, run.aggReader.Cps)
+	log.Printf("aggregate writing: %.3f %s %.0f send/s", run.aggWriter.Rate, app.Unit, run.aggWriter.Cps)
+
+	info := ExportInfo{
+		Unit:        app.Unit.String(),
+		InputStats:  run.aggReader.stats(),
+		OutputStats: run.aggWriter.stats(),
+	}
+	log.Printf("aggregate reading stats: %s %s", app.Unit, info.InputStats)
+	log.Printf("aggregate writing stats: %s %s", app.Unit, info.OutputStats)
+
+	result := run.result
+	result.Unit = info.Unit
+	result.Input = info.InputStats
+	result.Output = info.OutputStats
+	result.TransferErrors = atomic.LoadInt64(&run.aggReader.errors) + atomic.LoadInt64(&run.aggWriter.errors)
+
+	run.logHosts()
+	result.ByteMismatches = run.checkBytes()
+
+	if user, system, ok := cpuTime(); cpuOK && ok {
+		result.CPUUser = user - user0
+		result.CPUSystem = system - system0
+		logCPU(result.CPUUser, result.CPUSystem, time.Since(begin), result.Input.Bytes+result.Output.Bytes)
+	}
+
+	log.Printf("connections: %d/%d succeeded, max handshake rtt: %v", result.Connected, result.Attempted, result.MaxRTT)
+	if app.Opt.SyncStart {
+		log.Printf("synchronized start: max offset: %v", result.MaxStartOffset)
+	}
+	if result.ByteMismatches > 0 {
+		log.Printf("byte accounting: %d direction(s) with client and server byte counts not matching", result.ByteMismatches)
+	}
+	if app.Opt.Verify {
+		log.Printf("verify: %d corrupted block(s) received by client and servers", result.CorruptedBlocks)
+	}
+	if result.TransferErrors > 0 {
+		log.Printf("transfer errors: %d reader(s) or writer(s) ended by an error", result.TransferErrors)
+	}
+	if result.Expected > 0 {
+		log.Printf("aggregate loss: %.3f%% %d/%d datagrams", result.Loss(), result.Lost, result.Expected)
+	}
+
+	if result.Connected > 0 {
+		exportResults(app, &info, result.Connected, "aggregate")
+	}
+
+	return result
+}
+
+// openControls opens the control connections of hosts which have one in
+// parallel, so that an unreachable host does not delay the others, and gives
+// their cookie to the data connections.
+func openControls(hosts []*Config) []*ctlClient {
+	opened := make([]*ctlClient, len(hosts))
+	var wg sync.WaitGroup
+	for i, hc := range hosts {
+		if !hc.ControlConn {
+			continue
+		}
+		wg.Add(1)
+		go func(i int, hc *Config) {
+			defer wg.Done()
+			opened[i] = openControl(hc)
+		}(i, hc)
+	}
+	wg.Wait()
+
+	var ctls []*ctlClient
+	for i, cc := range opened {
+		if cc == nil {
+			continue
+		}
+		hosts[i].Opt.Cookie = cc.cookie
+		ctls = append(ctls, cc)
 	}
+	return ctls
+}
 
+// finishControls ends the tests on the servers and collects their results.
+func finishControls(ctls []*ctlClient, run *clientRun) {
 	var wg sync.WaitGroup
+	for _, cc := range ctls {
+		wg.Add(1)
+		go func(cc *ctlClient) {
+			defer wg.Done()
+			results, errFinish := cc.finish()
+			if errFinish != nil {
+				log.Printf("open: %s: control: %v", cc.host, errFinish)
+				return
+			}
+			run.serverResults(cc.host, results)
+		}(cc)
+	}
+	wg.Wait()
+}
+
+// openConnection dials connection c to the single host in hc,
+// retrying up to hc.ConnectRetries times.
+func openConnection(hc *Config, wg *sync.WaitGroup, c int, run *clientRun) {
+	proto := clientProto(hc)
+
+	dialer := newDialer(hc, proto)
 
-	var aggReader aggregate
-	var aggWriter aggregate
+	host := hc.Hosts[0]
+	hh := appendPortIfMissing(host, hc.DefaultPort)
 
-	is_connected := false
+	run.attempted(host)
 
-	dialer := net.Dialer{}
+	for attempt := 0; ; attempt++ {
+		log.Printf("open: opening TLS=%v %s %d/%d: %s attempt=%d", hc.TLS, proto, c, hc.Connections, hh, attempt)
+
+		conn, isTLS, errDial := dialConnection(hc, dialer, proto, hh)
+		if errDial == nil {
+			spawnClient(hc, wg, conn, c, hc.Connections, isTLS, run)
+			return
+		}
+
+		log.Printf("open: dial %s: %s: %v", proto, hh, errDial)
+		run.failed(host, errDial)
+
+		if attempt >= hc.ConnectRetries || !retryable(errDial) {
+			run.arrive()
+			return
+		}
+		time.Sleep(hc.ConnectRetryDelay)
+	}
+}
+
+func dialConnection(hc *Config, dialer net.Dialer, proto, hh string) (net.Conn, bool, error) {
+	if !hc.UDP && hc.TLS {
+		// try TLS first
+		log.Printf("open: trying TLS")
+		conn, errDialTLS := tlsDial(dialer, proto, hh)
+		if errDialTLS == nil {
+			return conn, true, nil
+		}
+		log.Printf("open: trying TLS: failure: %s: %s: %v", proto, hh, errDialTLS)
+	}
+
+	if !hc.UDP {
+		log.Printf("open: trying non-TLS TCP")
+	}
+
+	conn, errDial := dialer.Dial(proto, hh)
+	return conn, false, errDial
+}
+
+func clientProto(app *Config) string {
+	if app.UDP {
+		return "udp"
+	}
+	return "tcp"
+}
+
+func newDialer(app *Config, proto string) net.Dialer {
+	dialer := net.Dialer{Timeout: app.ConnectTimeout}
 
 	if app.LocalAddr != "" {
 		if app.UDP {
@@ -49,121 +444,246 @@ func open(app *Config) (bool, int64, int64) {
 		log.Printf("open: localAddr: %s", dialer.LocalAddr)
 	}
 
-	log.Printf("hosts: %s", app.Hosts)
-
-	for _, h := range app.Hosts {
+	return dialer
+}
 
-		hh := appendPortIfMissing(h, app.DefaultPort)
+func spawnClient(app *Config, wg *sync.WaitGroup, conn net.Conn, c, connections int, isTLS bool, run *clientRun) {
+	wg.Add(1)
+	go handleConnectionClient(app, wg, conn, c, connections, isTLS, run)
+}
 
-		for i := 0; i < app.Connections; i++ {
+func tlsDial(dialer net.Dialer, proto, h string) (net.Conn, error) {
+	conf := &tls.Config{
+		InsecureSkipVerify: true,
+	}
 
-			log.Printf("open: opening TLS=%v %s %d/%d: %s", app.TLS, proto, i, app.Connections, hh)
+	conn, err := tls.DialWithDialer(&dialer, proto, h, conf)
 
-			if !app.UDP && app.TLS {
-				// try TLS first
-				log.Printf("open: trying TLS")
-				conn, errDialTLS := tlsDial(dialer, proto, hh)
-				if errDialTLS == nil {
-					spawnClient(app, &wg, conn, i, app.Connections, true, &aggReader, &aggWriter)
-					continue
-				}
-				log.Printf("open: trying TLS: failure: %s: %s: %v", proto, hh, errDialTLS)
-			}
+	return conn, err
+}
 
-			if !app.UDP {
-				log.Printf("open: trying non-TLS TCP")
-			}
+// ExportInfo records data for export
+type ExportInfo struct {
+	Unit        string // rate unit for YValues and stats
+	Input       ChartData
+	Output      ChartData
+	InputStats  Stats
+	OutputStats Stats
+}
 
-			conn, errDial := dialer.Dial(proto, hh)
-			if errDial != nil {
-				log.Printf("open: dial %s: %s: %v", proto, hh, errDial)
-				continue
-			}
-			spawnClient(app, &wg, conn, i, app.Connections, false, &aggReader, &aggWriter)
-			is_connected = true
-		}
+func sendOptions(app *Config, conn io.Writer, opt Options) error {
+	w := newWire(app.Wire, app.UDP)
+	if errOpt := w.send(conn, &opt); errOpt != nil {
+		log.Printf("handleConnectionClient: %s options failure: %v", w, errOpt)
+		return errOpt
 	}
+	return nil
+}
 
-	wg.Wait()
-
-	log.Printf("aggregate reading: %d Mbps %d recv/s", aggReader.Mbps, aggReader.Cps)
-	log.Printf("aggregate writing: %d Mbps %d send/s", aggWriter.Mbps, aggWriter.Cps)
+// udpAckTimeout bounds the wait for UDP acks when ConnectTimeout is not set.
+const udpAckTimeout = 5 * time.Second
 
-	return is_connected, aggReader.Mbps, aggWriter.Mbps
+// handshakeDeadline is the deadline for the handshake, zero for none.
+func handshakeDeadline(app *Config) time.Time {
+	switch {
+	case app.ConnectTimeout > 0:
+		return time.Now().Add(app.ConnectTimeout)
+	case app.UDP && app.Opt.Auth:
+		return time.Now().Add(udpAckTimeout)
+	}
+	return time.Time{}
 }
 
-func spawnClient(app *Config, wg *sync.WaitGroup, conn net.Conn, c, connections int, isTLS bool, aggReader, aggWriter *aggregate) {
-	wg.Add(1)
-	go handleConnectionClient(app, wg, conn, c, connections, isTLS, aggReader, aggWriter)
+// clientHandshake sends options and waits for the server ack, answering
+// the authentication challenge if any. UDP without authentication gets
+// no ack.
+func clientHandshake(app *Config, conn net.Conn) error {
+	a, errHandshake := handshake(app, conn, app.Opt)
+	if errHandshake != nil {
+		return errHandshake
+	}
+	if a == nil {
+		return nil
+	}
+	return checkServerFeatures(app.Opt, *a)
 }
 
-func tlsDial(dialer net.Dialer, proto, h string) (net.Conn, error) {
-	conf := &tls.Config{
-		InsecureSkipVerify: true,
+// handshake sends opt and returns the last ack received, nil when UDP
+// without authentication gets no ack. The ack is also returned along with
+// the error when the server rejected the test.
+func handshake(app *Config, conn net.Conn, opt Options) (*ack, error) {
+	if errOpt := sendOptions(app, conn, opt); errOpt != nil {
+		return nil, errOpt
 	}
+	log.Printf("handleConnectionClient: options sent: %v", opt)
 
-	conn, err := tls.DialWithDialer(&dialer, proto, h, conf)
+	if app.UDP && !opt.Auth {
+		return nil, nil
+	}
 
-	return conn, err
+	w := newWire(app.Wire, app.UDP)
+
+	var a ack
+	if errAck := ackRecv(w, conn, &a); errAck != nil {
+		if app.UDP {
+			return nil, fmt.Errorf("receiving UDP ack, the server may predate UDP authentication: %v", errAck)
+		}
+		return nil, fmt.Errorf("receiving ack: %v", errAck)
+	}
+
+	if a.Nonce != nil {
+		if app.Secret == "" {
+			return nil, fmt.Errorf("server requires authentication: use -secret")
+		}
+		m := authMsg{Magic: authMagic, MAC: authMAC(app.Secret, a.Nonce)}
+		if errAuth := w.send(conn, &m); errAuth != nil {
+			return nil, fmt.Errorf("sending authentication: %v", errAuth)
+		}
+		a = ack{}
+		if errAck := ackRecv(w, conn, &a); errAck != nil {
+			return nil, fmt.Errorf("receiving ack: %v", errAck)
+		}
+	}
+
+	if a.Reject != "" {
+		return &a, fmt.Errorf("rejected by server: %s", a.Reject)
+	}
+
+	return &a, nil
 }
 
-// ExportInfo records data for export
-type ExportInfo struct {
-	Input  ChartData
-	Output ChartData
+// udpReject receives the reject ack which servers send to UDP clients of
+// protocol version 2 and later, even when the client does not wait for an
+// ack: the ack then arrives in place of the first test datagram.
+type udpReject struct {
+	once   sync.Once
+	done   chan struct{} // closed on reject
+	reason string
 }
 
-func sendOptions(app *Config, conn io.Writer) error {
-	opt := app.Opt
-	if app.UDP {
-		var optBuf bytes.Buffer
-		enc := gob.NewEncoder(&optBuf)
-		if errOpt := enc.Encode(&opt); errOpt != nil {
-			log.Printf("handleConnectionClient: UDP options failure: %v", errOpt)
-			return errOpt
+func newUDPReject() *udpReject {
+	return &udpReject{done: make(chan struct{})}
+}
+
+// rejected returns the error of the reject ack, nil if none was received.
+func (r *udpReject) rejected() error {
+	if !stopped(r.done) {
+		return nil
+	}
+	return fmt.Errorf("rejected by server: %s", r.reason)
+}
+
+// reader checks the first datagram read by f, which is a reject ack in the
+// wire format w instead of test data when the server refused the test.
+func (r *udpReject) reader(f call, w wire) call {
+	first := true
+	return func(b []byte) (int, error) {
+		n, err := f(b)
+		if n <= 0 || !first {
+			return n, err
 		}
-		_, optWriteErr := conn.Write(optBuf.Bytes())
-		if optWriteErr != nil {
-			log.Printf("handleConnectionClient: UDP options write: %v", optWriteErr)
-			return optWriteErr
+		first = false
+		if stamped(b[:n]) {
+			return n, err
 		}
-	} else {
-		enc := gob.NewEncoder(conn)
-		if errOpt := enc.Encode(&opt); errOpt != nil {
-			log.Printf("handleConnectionClient: TCP options failure: %v", errOpt)
-			return errOpt
+		var a ack
+		if w.decode(b[:n], &a) != nil || a.Magic != ackMagic || a.Reject == "" {
+			return n, err
 		}
+		r.once.Do(func() {
+			r.reason = a.Reject
+			close(r.done)
+		})
+		return 0, fmt.Errorf("%v: %w", r.rejected(), errTestEnd)
 	}
-	return nil
 }
 
-func handleConnectionClient(app *Config, wg *sync.WaitGroup, conn net.Conn, c, connections int, isTLS bool, aggReader, aggWriter *aggregate) {
+func handleConnectionClient(app *Config, wg *sync.WaitGroup, conn net.Conn, c, connections int, isTLS bool, run *clientRun) {
 	defer wg.Done()
 
 	log.Printf("handleConnectionClient: starting %s %d/%d %v", protoLabel(isTLS), c, connections, conn.RemoteAddr())
 
-	// send options
-	if errOpt := sendOptions(app, conn); errOpt != nil {
-		return
+	handshakeStart := time.Now()
+
+	host := app.Hosts[0]
+
+	arrived := false
+	defer func() {
+		if !arrived {
+			run.arrive() // do not hold other connections at the barrier
+		}
+	}()
+
+	conn.SetDeadline(handshakeDeadline(app))
+
+	// UDP options start the server transfer, so with SyncStart
+	// the UDP handshake happens only after the barrier
+	delayHandshake := app.UDP && app.Opt.SyncStart
+
+	var rtt time.Duration
+	if !delayHandshake {
+		if errHandshake := clientHandshake(app, conn); errHandshake != nil {
+			log.Printf("handleConnectionClient: handshake: %v", errHandshake)
+			run.failed(host, errHandshake)
+			conn.Close()
+			return
+		}
+		if !app.UDP {
+			rtt = time.Since(handshakeStart)
+			log.Printf("handleConnectionClient: %s ack received: rtt=%v", protoLabel(isTLS), rtt)
+		}
 	}
 	opt := app.Opt
-	log.Printf("handleConnectionClient: options sent: %v", opt)
 
-	// receive ack
-	// log.Printf("handleConnectionClient: FIXME WRITEME server does not send ack for UDP")
-	if !app.UDP {
-		var a ack
-		if errAck := ackRecv(app.UDP, conn, &a); errAck != nil {
-			log.Printf("handleConnectionClient: receiving ack: %v", errAck)
+	conn.SetDeadline(time.Time{})
+
+	start := time.Now()
+
+	if app.Opt.SyncStart {
+		arrived = true
+		start = run.waitStart()
+
+		var errStart error
+		if delayHandshake {
+			conn.SetDeadline(handshakeDeadline(app))
+			errStart = clientHandshake(app, conn)
+			conn.SetDeadline(time.Time{})
+		} else if app.Opt.Cookie == "" {
+			errStart = startSend(conn) // tests with a control connection start through it
+		}
+		if errStart != nil {
+			log.Printf("handleConnectionClient: synchronized start: %v", errStart)
+			run.failed(host, errStart)
+			conn.Close()
 			return
 		}
-		log.Printf("handleConnectionClient: %s ack received", protoLabel(isTLS))
+
+		offset := time.Since(start)
+		run.startOffset(offset)
+		log.Printf("handleConnectionClient: %d/%d synchronized start: offset=%v", c, connections, offset)
+	}
+
+	run.connected(host, rtt)
+
+	var seq *seqTracker
+	var reject *udpReject
+	var abort chan struct{} // nil never closes
+	if app.UDP {
+		seq = &seqTracker{}
+		reject = newUDPReject()
+		abort = reject.done
+	}
+
+	var verify *verifier
+	if opt.Verify {
+		verify = &verifier{}
 	}
 
 	doneReader := make(chan struct{})
 	doneWriter := make(chan struct{})
 
 	info := ExportInfo{
+		Unit:   app.Unit.String(),
 		Input:  ChartData{},
 		Output: ChartData{},
 	}
@@ -171,55 +691,77 @@ func handleConnectionClient(app *Config, wg *sync.WaitGroup, conn net.Conn, c, c
 	var input *ChartData
 	var output *ChartData
 
-	if app.Csv != "" || app.Export != "" || app.Chart != "" || app.ASCII {
+	if app.Csv != "" || app.Export != "" || app.JSON != "" || app.Chart != "" || app.ASCII {
 		input = &info.Input
 		output = &info.Output
 	}
 
 	bufSizeIn, bufSizeOut := getBufSize(opt, app.UDP)
 
-	go clientReader(conn, c, connections, doneReader, bufSizeIn, opt, input, aggReader)
-	if !app.PassiveClient {
-		go clientWriter(conn, c, connections, doneWriter, bufSizeOut, opt, output, aggWriter)
-	}
+	stopWriter := make(chan struct{})
 
-	tickerPeriod := time.NewTimer(app.Opt.TotalDuration)
+	go clientReader(conn, c, connections, doneReader, bufSizeIn, opt, newWire(app.Wire, app.UDP), seq, reject, verify, app.Unit, input, &info.InputStats, &run.aggReader)
+	if app.PassiveClient {
+		close(doneWriter)
+	} else {
+		go clientWriter(conn, c, connections, stopWriter, doneWriter, bufSizeOut, opt, app.UDP, app.Unit, output, &info.OutputStats, &run.aggWriter)
+	}
 
-	<-tickerPeriod.C
-	log.Printf("handleConnectionClient: %v timer", app.Opt.TotalDuration)
+	timeout, stopTimeout := opt.deadline(start)
 
-	tickerPeriod.Stop()
+	if opt.hasLimit() {
+		if waitTransfer(doneReader, doneWriter, timeout, abort) {
+			log.Printf("handleConnectionClient: %d/%d transfer completed in %v", c, connections, time.Since(start))
+		} else if !stopped(abort) {
+			log.Printf("handleConnectionClient: %d/%d transfer incomplete: %v timer", c, connections, opt.testDuration())
+		}
+	} else {
+		select {
+		case <-timeout:
+			log.Printf("handleConnectionClient: %v timer", opt.testDuration())
+		case <-abort:
+		}
+	}
 
-	conn.Close() // force reader/writer to quit
+	stopTimeout()
 
-	<-doneReader // wait reader exit
-	if !app.PassiveClient {
-		<-doneWriter // wait writer exit
+	drain := drainTimeout
+	if app.UDP {
+		drain = udpDrainTimeout
 	}
+	endTransfer(conn, stopWriter, doneReader, doneWriter, drain)
 
-	if app.Csv != "" {
+	conn.Close()
 
-		filename := fmt.Sprintf(app.Csv, c, formatAddress(conn))
-		log.Printf("exporting CSV test results to: %s", filename)
-		errExport := exportCsv(filename, &info)
-		if errExport != nil {
-			log.Printf("handleConnectionClient: export CSV: %s: %v", filename, errExport)
+	if reject != nil {
+		if errReject := reject.rejected(); errReject != nil {
+			log.Printf("handleConnectionClient: %d/%d %v", c, connections, errReject)
+			run.rejected(host, errReject)
+			return
 		}
 	}
 
-	if app.Export != "" {
-		filename := fmt.Sprintf(app.Export, c, formatAddress(conn))
-		log.Printf("exporting YAML test results to: %s", filename)
-		errExport := export(filename, &info)
-		if errExport != nil {
-			log.Printf("handleConnectionClient: export YAML: %s: %v", filename, errExport)
+	run.transferred(host, app.UDP, info.InputStats.Bytes, info.OutputStats.Bytes)
+
+	if verify != nil {
+		blocks, corrupted := verify.result()
+		log.Printf("handleConnectionClient: %d/%d verify: %d/%d block(s) corrupted", c, connections, corrupted, blocks)
+		run.corrupted(host, corrupted)
+	}
+
+	if seq != nil {
+		if expected, lost, ok := seq.loss(); ok {
+			log.Printf("handleConnectionClient: %d/%d input loss: %.3f%% %d/%d datagrams", c, connections, lossPercent(expected, lost), lost, expected)
+			run.addLoss(expected, lost)
 		}
 	}
 
+	exportResults(app, &info, c, formatAddress(conn))
+
 	if app.Chart != "" {
 		filename := fmt.Sprintf(app.Chart, c, formatAddress(conn))
 		log.Printf("rendering chart to: %s", filename)
-		errRender := chartRender(filename, &info.Input, &info.Output)
+		errRender := chartRender(filename, info.Unit, &info.Input, &info.Output)
 		if errRender != nil {
 			log.Printf("handleConnectionClient: render PNG: %s: %v", filename, errRender)
 		}
@@ -230,6 +772,36 @@ func handleConnectionClient(app *Config, wg *sync.WaitGroup, conn net.Conn, c, c
 	log.Printf("handleConnectionClient: closing: %d/%d %v", c, connections, conn.RemoteAddr())
 }
 
+// exportResults writes info to every export file enabled in app.
+func exportResults(app *Config, info *ExportInfo, c int, name string) {
+	if app.Csv != "" {
+		filename := fmt.Sprintf(app.Csv, c, name)
+		log.Printf("exporting CSV test results to: %s", filename)
+		errExport := exportCsv(filename, info)
+		if errExport != nil {
+			log.Printf("exportResults: export CSV: %s: %v", filename, errExport)
+		}
+	}
+
+	if app.Export != "" {
+		filename := fmt.Sprintf(app.Export, c, name)
+		log.Printf("exporting YAML test results to: %s", filename)
+		errExport := export(filename, info)
+		if errExport != nil {
+			log.Printf("exportResults: export YAML: %s: %v", filename, errExport)
+		}
+	}
+
+	if app.JSON != "" {
+		filename := fmt.Sprintf(app.JSON, c, name)
+		log.Printf("exporting JSON test results to: %s", filename)
+		errExport := exportJSON(filename, info)
+		if errExport != nil {
+			log.Printf("exportResults: export JSON: %s: %v", filename, errExport)
+		}
+	}
+}
+
 func getBufSize(opt Options, isUDP bool) (bufSizeIn int, bufSizeOut int) {
 	if isUDP {
 		bufSizeIn = opt.UDPReadSize
@@ -241,28 +813,58 @@ func getBufSize(opt Options, isUDP bool) (bufSizeIn int, bufSizeOut int) {
 	return
 }
 
-func clientReader(conn net.Conn, c, connections int, done chan struct{}, bufSize int, opt Options, stat *ChartData, agg *aggregate) {
+// clientReader counts UDP losses into seq and watches for a reject ack with
+// reject, both nil for TCP, and checks data with verify, which is nil
+// without Options.Verify.
+func clientReader(conn net.Conn, c, connections int, done chan struct{}, bufSize int, opt Options, w wire, seq *seqTracker, reject *udpReject, verify *verifier, unit Unit, stat *ChartData, summary *Stats, agg *aggregate) {
 	log.Printf("clientReader: starting: %d/%d %v", c, connections, conn.RemoteAddr())
 
 	connIndex := fmt.Sprintf("%d/%d", c, connections)
 
 	buf := make([]byte, bufSize)
 
-	workLoop(connIndex, "clientReader", "rcv/s", conn.Read, buf, opt.ReportInterval, 0, stat, agg)
+	udp := seq != nil
+	read := conn.Read
+	if udp {
+		read = reject.reader(read, w)
+	}
+	if verify != nil {
+		read = verifyReader(read, verify, udp)
+	}
+	if udp {
+		read = seqReader(read, seq)
+		if !opt.hasDeadline() {
+			read = idleReader(conn, read, udpIdleTimeout)
+		}
+	}
+
+	*summary = workLoop(connIndex, "clientReader", "rcv/s", read, buf, opt, udp, 0, unit, stat, agg, nil)
 
 	close(done)
 
 	log.Printf("clientReader: exiting: %d/%d %v", c, connections, conn.RemoteAddr())
 }
 
-func clientWriter(conn net.Conn, c, connections int, done chan struct{}, bufSize int, opt Options, stat *ChartData, agg *aggregate) {
+func clientWriter(conn net.Conn, c, connections int, stop, done chan struct{}, bufSize int, opt Options, udp bool, unit Unit, stat *ChartData, summary *Stats, agg *aggregate) {
 	log.Printf("clientWriter: starting: %d/%d %v", c, connections, conn.RemoteAddr())
 
 	connIndex := fmt.Sprintf("%d/%d", c, connections)
 
-	buf := randBuf(bufSize)
+	buf := payloadBuf(opt, bufSize)
+
+	write := conn.Write
+	if zeroCopy, release := zeroCopyWriter("clientWriter", conn, buf, opt); zeroCopy != nil {
+		write = zeroCopy
+		defer release()
+	}
+	if opt.Verify {
+		write = patternWrite(write, udp)
+	}
+	if udp {
+		write = seqWriter(write)
+	}
 
-	workLoop(connIndex, "clientWriter", "snd/s", conn.Write, buf, opt.ReportInterval, opt.MaxSpeed, stat, agg)
+	*summary = workLoop(connIndex, "clientWriter", "snd/s", write, buf, opt, udp, opt.MaxSpeed, unit, stat, agg, stop)
 
 	close(done)
 
@@ -280,11 +882,31 @@ func randBuf(size int) []byte {
 type call func(p []byte) (n int, err error)
 
 type account struct {
-	prevTime  time.Time
-	prevSize  int64
-	prevCalls int
-	size      int64
-	calls     int
+	begin      time.Time // never reset, covers warm-up
+	total      int64     // bytes including warm-up
+	totalCalls int64     // calls including warm-up
+	start      time.Time
+	prevTime   time.Time
+	prevSize   int64
+	prevCalls  int
+	size       int64
+	calls      int
+	unit       Unit
+	samples    []float64     // interval rates for stats
+	omit       time.Duration // warm-up period excluded from results
+	omitDone   bool
+	omitted    float64 // average rate during warm-up
+}
+
+func newAccount(start time.Time, unit Unit, omit time.Duration) *account {
+	return &account{
+		begin:    start,
+		start:    start,
+		prevTime: start,
+		unit:     unit,
+		omit:     omit,
+		omitDone: omit <= 0,
+	}
 }
 
 // ChartData records data for chart
@@ -293,57 +915,141 @@ type ChartData struct {
 	YValues []float64
 }
 
-const fmtReport = "%s %7s %14s rate: %6d Mbps %6d %s"
+const fmtReport = "%s %7s %14s rate: %10.3f %s %6d %s"
 
 func (a *account) update(n int, reportInterval time.Duration, conn, label, cpsLabel string, stat *ChartData) {
 	a.calls++
 	a.size += int64(n)
+	a.total += int64(n)
+	a.totalCalls++
 
 	now := time.Now()
+
+	if !a.omitDone && now.Sub(a.start) >= a.omit {
+		a.endOmit(now, conn, label, cpsLabel)
+		return
+	}
+
 	elap := now.Sub(a.prevTime)
 	if elap > reportInterval {
 		elapSec := elap.Seconds()
-		mbps := float64(8*(a.size-a.prevSize)) / (1000000 * elapSec)
+		rate := a.unit.scale(float64(8*(a.size-a.prevSize)) / elapSec)
 		cps := int64(float64(a.calls-a.prevCalls) / elapSec)
-		log.Printf(fmtReport, conn, "report", label, int64(mbps), cps, cpsLabel)
 		a.prevTime = now
 		a.prevSize = a.size
 		a.prevCalls = a.calls
 
+		if !a.omitDone {
+			log.Printf(fmtReport, conn, "omit", label, rate, a.unit, cps, cpsLabel)
+			return
+		}
+
+		log.Printf(fmtReport, conn, "report", label, rate, a.unit, cps, cpsLabel)
+		a.samples = append(a.samples, rate)
+
 		// save chart data
 		if stat != nil {
 			stat.XValues = append(stat.XValues, now)
-			stat.YValues = append(stat.YValues, mbps)
+			stat.YValues = append(stat.YValues, rate)
 		}
 	}
 }
 
 type aggregate struct {
-	Mbps  int64 // Megabit/s
-	Cps   int64 // Call/s
-	mutex sync.Mutex
+	live    int64     // bytes transferred so far, updated atomically
+	errors  int64     // transfers ended by an error, updated atomically
+	Rate    float64   // in report unit
+	Cps     float64   // Call/s
+	samples []float64 // sum of connection samples, aligned by interval index
+	omitted float64
+	bytes   int64
+	elapsed time.Duration // longest connection
+	mutex   sync.Mutex
 }
 
-func (a *account) average(start time.Time, conn, label, cpsLabel string, agg *aggregate) {
-	elapSec := time.Since(start).Seconds()
-	mbps := int64(float64(8*a.size) / (1000000 * elapSec))
-	cps := int64(float64(a.calls) / elapSec)
-	log.Printf(fmtReport, conn, "average", label, mbps, cps, cpsLabel)
-
+func (agg *aggregate) add(rate, cps float64, s Stats, samples []float64) {
 	agg.mutex.Lock()
-	agg.Mbps += mbps
+	defer agg.mutex.Unlock()
+
+	agg.Rate += rate
 	agg.Cps += cps
-	agg.mutex.Unlock()
+	agg.omitted += s.Omitted
+	agg.bytes += s.Bytes
+	if s.Elapsed > agg.elapsed {
+		agg.elapsed = s.Elapsed
+	}
+	for i, v := range samples {
+		if i < len(agg.samples) {
+			agg.samples[i] += v
+		} else {
+			agg.samples = append(agg.samples, v)
+		}
+	}
 }
 
-func workLoop(conn, label, cpsLabel string, f call, buf []byte, reportInterval time.Duration, maxSpeed float64, stat *ChartData, agg *aggregate) {
-	start := time.Now()
-	acc := &account{}
-	acc.prevTime = start
+func (agg *aggregate) stats() Stats {
+	agg.mutex.Lock()
+	defer agg.mutex.Unlock()
+	s := computeStats(agg.Rate, agg.samples)
+	s.Omitted = agg.omitted
+	s.Bytes = agg.bytes
+	s.Elapsed = agg.elapsed
+	return s
+}
 
-	for {
-		runtime.Gosched()
+// endOmit reports the warm-up period and restarts accounting from now.
+func (a *account) endOmit(now time.Time, conn, label, cpsLabel string) {
+	elapSec := now.Sub(a.start).Seconds()
+	a.omitted = a.unit.scale(float64(8*a.size) / elapSec)
+	cps := int64(float64(a.calls) / elapSec)
+	log.Printf(fmtReport, conn, "omitted", label, a.omitted, a.unit, cps, cpsLabel)
+
+	a.omitDone = true
+	a.start = now
+	a.prevTime = now
+	a.size = 0
+	a.prevSize = 0
+	a.calls = 0
+	a.prevCalls = 0
+}
+
+func (a *account) average(conn, label, cpsLabel string, agg *aggregate) Stats {
+	if !a.omitDone {
+		log.Printf("%s %7s %14s test ended during %v omit period", conn, "average", label, a.omit)
+		a.endOmit(time.Now(), conn, label, cpsLabel)
+	}
 
+	elapSec := time.Since(a.start).Seconds()
+	var rate, cps float64
+	if elapSec > 0 {
+		rate = a.unit.scale(float64(8*a.size) / elapSec)
+		cps = float64(a.calls) / elapSec
+	}
+	log.Printf(fmtReport, conn, "average", label, rate, a.unit, int64(cps), cpsLabel)
+
+	stats := computeStats(rate, a.samples)
+	stats.Omitted = a.omitted
+	stats.Bytes = a.total
+	stats.Elapsed = time.Since(a.begin)
+	log.Printf("%s %7s %14s %s %s", conn, "stats", label, a.unit, stats)
+
+	agg.add(rate, cps, stats, a.samples)
+
+	return stats
+}
+
+// limitReached checks the transfer limit, where zero means unlimited.
+func (a *account) limitReached(bytes, calls int64) bool {
+	return (bytes > 0 && a.total >= bytes) || (calls > 0 && a.totalCalls >= calls)
+}
+
+// workLoop calls f until the transfer limit, an error, or stop is closed.
+// Readers pass a nil stop, they end when the peer half-closes.
+func workLoop(conn, label, cpsLabel string, f call, buf []byte, opt Options, udp bool, maxSpeed float64, unit Unit, stat *ChartData, agg *aggregate, stop <-chan struct{}) Stats {
+	acc := newAccount(time.Now(), unit, opt.Omit)
+	limitBytes, limitCalls := opt.transferLimit(udp)
+
+	for !stopped(stop) {
 		if maxSpeed > 0 {
 			elapSec := time.Since(acc.prevTime).Seconds()
 			if elapSec > 0 {
@@ -355,16 +1061,35 @@ func workLoop(conn, label, cpsLabel string, f call, buf []byte, reportInterval t
 			}
 		}
 
-		n, errCall := f(buf)
+		b := buf
+		if limitBytes > 0 {
+			if remaining := limitBytes - acc.total; remaining < int64(len(b)) {
+				b = b[:remaining]
+			}
+		}
+
+		n, errCall := f(b)
 		if errCall != nil {
-			log.Printf("workLoop: %s %s: %v", conn, label, errCall)
+			if endOfTest(errCall) {
+				log.Printf("workLoop: %s %s: end: %v", conn, label, errCall)
+			} else {
+				log.Printf("workLoop: %s %s: error: %v", conn, label, errCall)
+				atomic.AddInt64(&agg.errors, 1)
+			}
 			break
 		}
 
-		acc.update(n, reportInterval, conn, label, cpsLabel, stat)
+		atomic.AddInt64(&agg.live, int64(n))
+		acc.update(n, opt.ReportInterval, conn, label, cpsLabel, stat)
+
+		if acc.limitReached(limitBytes, limitCalls) {
+			log.Printf("workLoop: %s %s: transfer complete: %d bytes %d calls in %v",
+				conn, label, acc.total, acc.totalCalls, time.Since(acc.begin))
+			break
+		}
 	}
 
-	acc.average(start, conn, label, cpsLabel, agg)
+	return acc.average(conn, label, cpsLabel, agg)
 }
 
 // Remove semi colon, invalid use in filename on windows
@@ -375,7 +1100,20 @@ func formatAddress(con net.Conn) string {
 	return fmt.Sprintf("%v", con.RemoteAddr())
 }
 
-// BuildClient for another lib to use
-func BuildClient(app *Config) {
-	open(app)
+// BuildClient for another lib to use.
+// The error is ErrNoConnection when no connection succeeded,
+// or a *ThresholdError when an assertion in app.Thresholds failed.
+// Other errors report invalid host overrides in app.Hosts.
+func BuildClient(app *Config) (Result, error) {
+	app.Opt.Auth = app.Secret != ""
+	hosts, errHosts := hostConfigs(app)
+	if errHosts != nil {
+		return Result{}, errHosts
+	}
+	for _, hc := range hosts {
+		hc.Opt.Version = ProtocolVersion
+		hc.Opt.Features = hc.Opt.usedFeatures()
+	}
+	result := open(app, hosts)
+	return result, evaluate(app, result)
 }
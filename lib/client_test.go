@@ -0,0 +1,242 @@
+package lib
+
+import (
+	"errors"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestWaitStartHoldsUntilAllArrive(t *testing.T) {
+	run := &clientRun{syncStart: true}
+	run.barrier.Add(3)
+	var started int32
+	run.onStart = func() { atomic.AddInt32(&started, 1) }
+
+	var late time.Time
+	starts := make(chan time.Time, 3)
+	for i := 0; i < 3; i++ {
+		go func(i int) {
+			if i == 2 {
+				time.Sleep(200 * time.Millisecond)
+				late = time.Now()
+			}
+			starts <- run.waitStart()
+		}(i)
+	}
+
+	first := waitFor(t, starts)
+	for i := 1; i < 3; i++ {
+		if s := waitFor(t, starts); !s.Equal(first) {
+			t.Errorf("start times differ: %v %v", first, s)
+		}
+	}
+	if first.Before(late) {
+		t.Errorf("barrier opened %v before the last connection arrived", late.Sub(first))
+	}
+	if n := atomic.LoadInt32(&started); n != 1 {
+		t.Errorf("onStart called %d times, wanted once", n)
+	}
+}
+
+func TestWaitStartReleasedByFailure(t *testing.T) {
+	run := &clientRun{syncStart: true}
+	run.barrier.Add(3)
+
+	starts := make(chan time.Time, 2)
+	for i := 0; i < 2; i++ {
+		go func() { starts <- run.waitStart() }()
+	}
+	time.Sleep(50 * time.Millisecond)
+	select {
+	case <-starts:
+		t.Fatalf("barrier opened before the third connection")
+	default:
+	}
+
+	run.arrive() // third connection failed
+	waitFor(t, starts)
+	waitFor(t, starts)
+}
+
+func waitFor(t *testing.T, starts chan time.Time) time.Time {
+	select {
+	case s := <-starts:
+		return s
+	case <-time.After(5 * time.Second):
+		t.Fatalf("barrier never opened")
+	}
+	return time.Time{}
+}
+
+func TestSyncStartFailedDial(t *testing.T) {
+	addr := testServer(t)
+
+	listener, errListen := net.Listen("tcp", "127.0.0.1:0")
+	if errListen != nil {
+		t.Fatal(errListen)
+	}
+	closed := listener.Addr().String()
+	listener.Close() // dials to closed are refused
+
+	app := testClientConfig(addr)
+	app.Hosts = []string{addr, closed}
+	app.Connections = 2
+	app.Opt.SyncStart = true
+	app.Thresholds.RequireAll = true
+
+	var result Result
+	var err error
+	done := make(chan struct{})
+	go func() {
+		result, err = BuildClient(&app)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(10 * time.Second):
+		t.Fatalf("client held at the start barrier by failed dials")
+	}
+
+	if result.Attempted != 4 || result.Connected != 2 {
+		t.Errorf("connections: %d/%d wanted 2/4", result.Connected, result.Attempted)
+	}
+	if result.Input.Bytes == 0 || result.Output.Bytes == 0 {
+		t.Errorf("connected hosts transferred nothing: input=%d output=%d", result.Input.Bytes, result.Output.Bytes)
+	}
+	if _, isThreshold := err.(*ThresholdError); !isThreshold {
+		t.Errorf("requireAll: error=%v wanted threshold error", err)
+	}
+}
+
+func TestErrorClass(t *testing.T) {
+	refused := func(port int) error {
+		return &net.OpError{
+			Op:   "dial",
+			Net:  "tcp",
+			Addr: &net.TCPAddr{IP: net.IPv4(10, 0, 0, 1), Port: port},
+			Err:  os.NewSyscallError("connect", syscall.ECONNREFUSED),
+		}
+	}
+	if a, b := errorClass(refused(8080)), errorClass(refused(8081)); a != b || a != "dial: "+syscall.ECONNREFUSED.Error() {
+		t.Errorf("errorClass: %q %q", a, b)
+	}
+
+	timeout := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("i/o timeout")}
+	if c := errorClass(timeout); c != "dial: i/o timeout" {
+		t.Errorf("errorClass: %q", c)
+	}
+	if c := errorClass(errors.New("handshake: rejected")); c != "handshake: rejected" {
+		t.Errorf("errorClass: %q", c)
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	table := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"refused", &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, true},
+		{"timeout", &net.OpError{Op: "dial", Err: &net.DNSError{Err: "i/o timeout", IsTimeout: true}}, true},
+		{"dns temporary", &net.OpError{Op: "dial", Err: &net.DNSError{Err: "server misbehaving", IsTemporary: true}}, true},
+		{"other", errors.New("EOF"), true},
+		{"unknown host", &net.OpError{Op: "dial", Err: &net.DNSError{Err: "no such host", IsNotFound: true}}, false},
+		{"bad port", &net.OpError{Op: "dial", Err: &net.AddrError{Err: "invalid port", Addr: "99999"}}, false},
+		{"bad network", &net.OpError{Op: "dial", Err: net.UnknownNetworkError("tcp5")}, false},
+	}
+	for _, d := range table {
+		if r := retryable(d.err); r != d.want {
+			t.Errorf("retryable: %s: result=%v wanted=%v", d.name, r, d.want)
+		}
+	}
+}
+
+func TestConnectRetries(t *testing.T) {
+	listener, errListen := net.Listen("tcp", "127.0.0.1:0")
+	if errListen != nil {
+		t.Fatal(errListen)
+	}
+	closed := listener.Addr().String()
+	listener.Close()
+
+	table := []struct {
+		host    string
+		retries int
+		errors  int // dial errors counted
+	}{
+		{closed, 0, 1},
+		{closed, 2, 3},
+		{"127.0.0.1:99999", 2, 1}, // fatal, not retried
+	}
+
+	for _, d := range table {
+		hc := testClientConfig(d.host)
+		hc.ConnectRetries = d.retries
+		hc.ConnectRetryDelay = time.Millisecond
+		hc.Opt.SyncStart = true
+
+		run := newClientRun([]*Config{&hc})
+		run.syncStart = true
+		run.barrier.Add(1)
+
+		var wg sync.WaitGroup
+		openConnection(&hc, &wg, 0, run)
+		wg.Wait()
+
+		hr := run.result.Hosts[0]
+		var count int
+		for _, n := range hr.Errors {
+			count += n
+		}
+		if hr.Attempted != 1 || hr.Connected != 0 || count != d.errors {
+			t.Errorf("%s retries=%d: attempted=%d connected=%d errors=%v wanted %d error(s)", d.host, d.retries, hr.Attempted, hr.Connected, hr.Errors, d.errors)
+		}
+
+		released := make(chan struct{})
+		go func() {
+			run.barrier.Wait()
+			close(released)
+		}()
+		select {
+		case <-released:
+		case <-time.After(5 * time.Second):
+			t.Errorf("%s retries=%d: start barrier not released", d.host, d.retries)
+		}
+	}
+}
+
+func TestAggregateExportCount(t *testing.T) {
+	addr1, addr2 := testServer(t), testServer(t)
+
+	listener, errListen := net.Listen("tcp", "127.0.0.1:0")
+	if errListen != nil {
+		t.Fatal(errListen)
+	}
+	closed := listener.Addr().String()
+	listener.Close()
+
+	dir, errDir := ioutil.TempDir("", "goben-aggregate")
+	if errDir != nil {
+		t.Fatal(errDir)
+	}
+	defer os.RemoveAll(dir)
+
+	app := testClientConfig(addr1)
+	app.Hosts = []string{addr1, addr2, closed}
+	app.Csv = filepath.Join(dir, "csv-%d-%s.csv")
+
+	result, _ := BuildClient(&app)
+	if result.Connected != 2 {
+		t.Fatalf("connections: %d/%d wanted 2/3", result.Connected, result.Attempted)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "csv-2-aggregate.csv")); err != nil {
+		t.Errorf("aggregate export not labelled with the 2 reporting connections: %v", err)
+	}
+}
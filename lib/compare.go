@@ -0,0 +1,250 @@
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/wcharczuk/go-chart"
+	"gopkg.in/yaml.v2"
+)
+
+// CompareConfig controls comparison of exported results.
+type CompareConfig struct {
+	Files     []string // export files, the first one is the baseline
+	Threshold float64  // percent drop from baseline flagged as regression
+	Chart     string   // optional PNG output with all runs
+	Unit      Unit     // report unit, defaults to the baseline unit
+}
+
+// loadExport reads an ExportInfo from a YAML or JSON file.
+func loadExport(filename string) (*ExportInfo, error) {
+	b, errRead := ioutil.ReadFile(filename)
+	if errRead != nil {
+		return nil, errRead
+	}
+
+	var info ExportInfo
+
+	if strings.ToLower(filepath.Ext(filename)) == ".json" {
+		if errJSON := json.Unmarshal(b, &info); errJSON != nil {
+			return nil, fmt.Errorf("loadExport: %s: %v", filename, errJSON)
+		}
+	} else {
+		if errYAML := yaml.Unmarshal(b, &info); errYAML != nil {
+			return nil, fmt.Errorf("loadExport: %s: %v", filename, errYAML)
+		}
+	}
+
+	// exports older than stats support only carry samples
+	if info.InputStats.Samples == 0 && len(info.Input.YValues) > 0 {
+		info.InputStats = computeStats(mean(info.Input.YValues), info.Input.YValues)
+	}
+	if info.OutputStats.Samples == 0 && len(info.Output.YValues) > 0 {
+		info.OutputStats = computeStats(mean(info.Output.YValues), info.Output.YValues)
+	}
+
+	return &info, nil
+}
+
+func mean(values []float64) float64 {
+	if len(values) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
+
+// exportUnit returns the unit recorded in an export, older exports used Mbps.
+func exportUnit(info *ExportInfo) Unit {
+	if info.Unit == "" {
+		return DefaultUnit
+	}
+	u, err := ParseUnit(info.Unit)
+	if err != nil {
+		log.Printf("exportUnit: %v: assuming %s", err, DefaultUnit)
+		return DefaultUnit
+	}
+	return u
+}
+
+// convert rescales every rate in info to unit.
+func (info *ExportInfo) convert(unit Unit) {
+	factor := exportUnit(info).Bits / unit.orDefault().Bits
+	if factor != 1 {
+		for _, d := range []*ChartData{&info.Input, &info.Output} {
+			for i := range d.YValues {
+				d.YValues[i] *= factor
+			}
+		}
+		for _, s := range []*Stats{&info.InputStats, &info.OutputStats} {
+			s.Average *= factor
+			s.Min *= factor
+			s.Max *= factor
+			s.Mean *= factor
+			s.StdDev *= factor
+			s.P5 *= factor
+			s.P50 *= factor
+			s.P95 *= factor
+			s.Omitted *= factor
+		}
+	}
+	info.Unit = unit.String()
+}
+
+type compareMetric struct {
+	name       string
+	value      func(s Stats) float64
+	throughput bool // a drop is a regression
+}
+
+var compareMetrics = []compareMetric{
+	{"average", func(s Stats) float64 { return s.Average }, true},
+	{"p5", func(s Stats) float64 { return s.P5 }, true},
+	{"p50", func(s Stats) float64 { return s.P50 }, true},
+	{"p95", func(s Stats) float64 { return s.P95 }, true},
+	{"min", func(s Stats) float64 { return s.Min }, false},
+	{"max", func(s Stats) float64 { return s.Max }, false},
+	{"stddev", func(s Stats) float64 { return s.StdDev }, false},
+	{"cv", func(s Stats) float64 { return s.CV }, false},
+}
+
+// Compare prints a table comparing exported runs against the first one.
+// It returns the number of throughput metrics which dropped more than
+// the threshold below the baseline.
+func Compare(cfg CompareConfig, w io.Writer) (int, error) {
+	if len(cfg.Files) < 2 {
+		return 0, fmt.Errorf("Compare: need at least two export files, got %d", len(cfg.Files))
+	}
+
+	infos := make([]*ExportInfo, 0, len(cfg.Files))
+	for _, f := range cfg.Files {
+		info, errLoad := loadExport(f)
+		if errLoad != nil {
+			return 0, errLoad
+		}
+		infos = append(infos, info)
+	}
+
+	unit := cfg.Unit
+	if unit.Bits <= 0 {
+		unit = exportUnit(infos[0])
+	}
+	for _, info := range infos {
+		info.convert(unit)
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', tabwriter.AlignRight)
+
+	header := []string{"DIRECTION", "METRIC", unit.String() + " " + cfg.Files[0]}
+	for _, f := range cfg.Files[1:] {
+		header = append(header, f, "DELTA")
+	}
+	fmt.Fprintln(tw, strings.Join(header, "\t")+"\t")
+
+	var regressions int
+
+	for _, dir := range []string{"input", "output"} {
+		for _, m := range compareMetrics {
+			base := m.value(directionStats(infos[0], dir))
+			row := []string{dir, m.name, fmt.Sprintf("%.3f", base)}
+			for _, info := range infos[1:] {
+				v := m.value(directionStats(info, dir))
+				delta := "-"
+				if base != 0 {
+					pct := 100 * (v - base) / base
+					delta = fmt.Sprintf("%+.1f%%", pct)
+					if m.throughput && -pct > cfg.Threshold {
+						delta += " REGRESSION"
+						regressions++
+					}
+				}
+				row = append(row, fmt.Sprintf("%.3f", v), delta)
+			}
+			fmt.Fprintln(tw, strings.Join(row, "\t")+"\t")
+		}
+	}
+
+	if errFlush := tw.Flush(); errFlush != nil {
+		return regressions, errFlush
+	}
+
+	if cfg.Chart != "" {
+		log.Printf("rendering comparison chart to: %s", cfg.Chart)
+		if errChart := chartCompare(cfg.Chart, unit.String(), cfg.Files, infos); errChart != nil {
+			return regressions, errChart
+		}
+	}
+
+	return regressions, nil
+}
+
+func directionStats(info *ExportInfo, dir string) Stats {
+	if dir == "input" {
+		return info.InputStats
+	}
+	return info.OutputStats
+}
+
+// chartCompare plots every run against seconds since its first sample.
+func chartCompare(filename, unit string, names []string, infos []*ExportInfo) error {
+	var series []chart.Series
+
+	for i, info := range infos {
+		for _, d := range []struct {
+			label string
+			data  ChartData
+		}{{"input", info.Input}, {"output", info.Output}} {
+			if len(d.data.XValues) == 0 {
+				continue
+			}
+			x := make([]float64, len(d.data.XValues))
+			for j, t := range d.data.XValues {
+				x[j] = t.Sub(d.data.XValues[0]).Seconds()
+			}
+			series = append(series, chart.ContinuousSeries{
+				Name:    fmt.Sprintf("%s %s", filepath.Base(names[i]), d.label),
+				XValues: x,
+				YValues: d.data.YValues,
+			})
+		}
+	}
+
+	if len(series) == 0 {
+		return fmt.Errorf("chartCompare: no samples to plot")
+	}
+
+	out, errCreate := os.Create(filename)
+	if errCreate != nil {
+		return errCreate
+	}
+	defer out.Close()
+
+	graph := chart.Chart{
+		XAxis: chart.XAxis{
+			Name: "Seconds",
+			Style: chart.Style{
+				Show: true,
+			},
+		},
+		YAxis: chart.YAxis{
+			Name: unit,
+			Style: chart.Style{
+				Show: true,
+			},
+		},
+		Series: series,
+	}
+	graph.Elements = []chart.Renderable{chart.Legend(&graph)}
+
+	return graph.Render(chart.PNG, out)
+}
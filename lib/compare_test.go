@@ -0,0 +1,145 @@
+package lib
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// baseline export in Mbps, with stats
+const testBaseline = `
+unit: Mbps
+inputstats: {samples: 3, average: 100, min: 90, max: 110, mean: 100, p5: 91, p50: 100, p95: 109}
+outputstats: {samples: 3, average: 200, min: 180, max: 220, mean: 200, p5: 180, p50: 200, p95: 220}
+`
+
+// run export in Gbps, input from samples only as in older exports
+const testRun = `{
+  "Unit": "Gbps",
+  "Input": {"YValues": [0.09, 0.09, 0.09]},
+  "OutputStats": {"Samples": 3, "Average": 0.198, "Min": 0.17, "Max": 0.23, "Mean": 0.2, "P5": 0.19, "P50": 0.2, "P95": 0.22}
+}`
+
+func writeCompareFiles(t *testing.T) (string, []string) {
+	dir, errDir := ioutil.TempDir("", "goben-compare")
+	if errDir != nil {
+		t.Fatal(errDir)
+	}
+	files := []string{filepath.Join(dir, "base.yaml"), filepath.Join(dir, "run.json")}
+	for i, content := range []string{testBaseline, testRun} {
+		if err := ioutil.WriteFile(files[i], []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir, files
+}
+
+func TestLoadExport(t *testing.T) {
+	dir, files := writeCompareFiles(t)
+	defer os.RemoveAll(dir)
+
+	base, errBase := loadExport(files[0])
+	if errBase != nil {
+		t.Fatal(errBase)
+	}
+	expectFloat(t, "yaml input p5", base.InputStats.P5, 91)
+	expectFloat(t, "yaml output average", base.OutputStats.Average, 200)
+
+	run, errRun := loadExport(files[1])
+	if errRun != nil {
+		t.Fatal(errRun)
+	}
+	if run.InputStats.Samples != 3 {
+		t.Errorf("json input stats from samples: samples=%d wanted=3", run.InputStats.Samples)
+	}
+	expectFloat(t, "json input average", run.InputStats.Average, 0.09)
+
+	run.convert(exportUnit(base))
+	if run.Unit != "Mbps" {
+		t.Errorf("convert: unit=%q wanted=Mbps", run.Unit)
+	}
+	expectFloat(t, "converted input average", run.InputStats.Average, 90)
+	expectFloat(t, "converted input sample", run.Input.YValues[0], 90)
+	expectFloat(t, "converted output p95", run.OutputStats.P95, 220)
+
+	if _, err := loadExport(filepath.Join(dir, "missing.yaml")); err == nil {
+		t.Errorf("loadExport: missing file: expected error")
+	}
+}
+
+func TestCompare(t *testing.T) {
+	dir, files := writeCompareFiles(t)
+	defer os.RemoveAll(dir)
+
+	table := []struct {
+		threshold   float64
+		regressions []string // direction and metric flagged
+	}{
+		{5, []string{"input average", "input p50", "input p95"}}, // -10%, -10%, -17.4%
+		{15, []string{"input p95"}},
+		{20, nil},
+	}
+
+	for _, d := range table {
+		var out bytes.Buffer
+		regressions, err := Compare(CompareConfig{Files: files, Threshold: d.threshold}, &out)
+		if err != nil {
+			t.Fatalf("threshold %v: %v", d.threshold, err)
+		}
+		if regressions != len(d.regressions) {
+			t.Errorf("threshold %v: regressions=%d wanted=%d", d.threshold, regressions, len(d.regressions))
+		}
+
+		var flagged []string
+		for _, line := range strings.Split(out.String(), "\n") {
+			fields := strings.Fields(line)
+			if len(fields) > 0 && fields[len(fields)-1] == "REGRESSION" {
+				flagged = append(flagged, fields[0]+" "+fields[1])
+			}
+		}
+		if strings.Join(flagged, ",") != strings.Join(d.regressions, ",") {
+			t.Errorf("threshold %v: flagged=%v wanted=%v", d.threshold, flagged, d.regressions)
+		}
+	}
+}
+
+func TestCompareUnit(t *testing.T) {
+	dir, files := writeCompareFiles(t)
+	defer os.RemoveAll(dir)
+
+	unit, _ := ParseUnit("Gbps")
+	var out bytes.Buffer
+	if _, err := Compare(CompareConfig{Files: files, Threshold: 5, Unit: unit}, &out); err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(out.String(), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 5 && fields[0] == "input" && fields[1] == "average" {
+			if fields[2] != "0.100" || fields[3] != "0.090" || fields[4] != "-10.0%" {
+				t.Errorf("input average in Gbps: %q", line)
+			}
+			return
+		}
+	}
+	t.Errorf("input average row not found:\n%s", out.String())
+}
+
+func TestCompareErrors(t *testing.T) {
+	dir, files := writeCompareFiles(t)
+	defer os.RemoveAll(dir)
+
+	if _, err := Compare(CompareConfig{Files: files[:1]}, ioutil.Discard); err == nil {
+		t.Errorf("one file: expected error")
+	}
+
+	bad := filepath.Join(dir, "bad.json")
+	if err := ioutil.WriteFile(bad, []byte("{"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := Compare(CompareConfig{Files: []string{files[0], bad}}, ioutil.Discard); err == nil {
+		t.Errorf("bad json: expected error")
+	}
+}
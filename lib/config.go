@@ -16,24 +16,47 @@ type Config struct {
 	DefaultPort    string
 	ReportInterval string
 	TotalDuration  string
+	Omit           string
 	Chart          string
 	Export         string
 	Csv            string
+	JSON           string
 	TLSCert        string
 	TLSKey         string
 	LocalAddr      string
+	Control        string // listen address for the HTTP control API, empty disables
+	Secret         string `json:"-"` // shared secret for client authentication, empty disables, never sent to agents
+	Wire           string // client handshake format: WireGob or WireJSON
+	PayloadFile    string // file loaded into Opt.PayloadData with PayloadFile
+	Units          string // rate unit name, see ParseUnit
+	Unit           Unit   // parsed from Units
 	Opt            Options
-	ASCII          bool // plot ascii chart
+	Thresholds     Thresholds
+	Limits         Limits // server-side, changed at runtime through the control API
+	ASCII          bool   // plot ascii chart
 	TLS            bool
 	PassiveClient  bool // suppress client send
 	UDP            bool
 	Connections    int
+	RampUp         time.Duration // delay between connection starts
+	RampDown       time.Duration // delay between connection stops
+
+	ConnectTimeout    time.Duration // dial and handshake timeout, zero means none
+	ConnectRetries    int           // dial retries after the first attempt
+	ConnectRetryDelay time.Duration
+
+	ControlConn bool // open a control connection per host, if the server supports it
 }
 
 func (h *hostList) String() string {
 	return fmt.Sprint(*h)
 }
 
+// Reset clears the list, so that a later Set replaces it.
+func (h *hostList) Reset() {
+	*h = nil
+}
+
 func (h *hostList) Set(value string) error {
 	for _, hh := range strings.Split(value, ",") {
 		*h = append(*h, hh)
@@ -46,11 +69,94 @@ func (h *hostList) Set(value string) error {
 type Options struct {
 	ReportInterval time.Duration
 	TotalDuration  time.Duration
+	Omit           time.Duration // warm-up excluded from results, runs before TotalDuration
+	TotalBytes     int64         // stop each direction after this many bytes (0 means unlimited)
+	TotalPackets   int64         // stop each direction after this many datagrams or TCP writes (0 means unlimited)
 	TCPReadSize    int
 	TCPWriteSize   int
 	UDPReadSize    int
 	UDPWriteSize   int
 	PassiveServer  bool              // suppress server send
+	SyncStart      bool              // all client connections start at once, TCP server waits for a start message after the ack
+	Auth           bool              // client answers an authentication challenge, UDP server sends acks
+	Version        int               // protocol version, see ProtocolVersion
+	Features       []string          // protocol features used by the test
+	Control        bool              // this connection is the control connection of a test
+	Cookie         string            // data connection of the test with this cookie, see ack
+	Verify         bool              // test data follows a pattern checked by readers
+	Payload        string            // test data written: PayloadRandom (default), PayloadZeros, PayloadCompressible or PayloadFile
+	PayloadRatio   float64           // PayloadCompressible: approximate compression ratio, e.g. 2 for 2:1
+	PayloadData    payloadData       // PayloadFile: file contents, repeated to fill writes
+	ZeroCopy       bool              // TCP writers send with sendfile on Linux
 	MaxSpeed       float64           // mbps
 	Table          map[string]string // send optional information client->server
 }
+
+// String prints the options for logs, with the cookie shortened like
+// testCtl.id, since a valid cookie admits data connections without the
+// secret. PayloadData prints its size only.
+func (o Options) String() string {
+	type fields Options // without String, for the default format
+	f := fields(o)
+	if f.Cookie != "" {
+		f.Cookie = cookieID(f.Cookie) + "..."
+	}
+	return fmt.Sprint(f)
+}
+
+// testDuration includes the warm-up period.
+func (o Options) testDuration() time.Duration {
+	return o.Omit + o.TotalDuration
+}
+
+// hasDeadline is false when a transfer limit runs without TotalDuration.
+func (o Options) hasDeadline() bool {
+	return o.TotalDuration > 0 || !o.hasLimit()
+}
+
+// hasLimit reports whether the test ends on a byte or packet count.
+func (o Options) hasLimit() bool {
+	return o.TotalBytes > 0 || o.TotalPackets > 0
+}
+
+// transferLimit converts the requested limit into bytes and calls for one direction.
+// Over TCP a packet is one TCPWriteSize write, so it is counted as bytes,
+// since reads do not match writes.
+func (o Options) transferLimit(udp bool) (bytes, calls int64) {
+	bytes = o.TotalBytes
+	if udp {
+		return bytes, o.TotalPackets
+	}
+	if bytes == 0 && o.TotalPackets > 0 {
+		bytes = o.TotalPackets * int64(o.TCPWriteSize)
+	}
+	return bytes, 0
+}
+
+// deadline returns a timer channel for the test duration counted from start,
+// or nil (blocking forever) when there is no deadline.
+func (o Options) deadline(start time.Time) (<-chan time.Time, func() bool) {
+	if !o.hasDeadline() {
+		return nil, func() bool { return false }
+	}
+	t := time.NewTimer(time.Until(start.Add(o.testDuration())))
+	return t.C, t.Stop
+}
+
+// waitTransfer waits for both directions to finish, for timeout to fire or
+// for abort to close. It returns false on timeout or abort.
+func waitTransfer(doneReader, doneWriter chan struct{}, timeout <-chan time.Time, abort <-chan struct{}) bool {
+	for doneReader != nil || doneWriter != nil {
+		select {
+		case <-doneReader:
+			doneReader = nil
+		case <-doneWriter:
+			doneWriter = nil
+		case <-timeout:
+			return false
+		case <-abort:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,387 @@
+package lib
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// defaultControlPort is used for agent addresses without port.
+const defaultControlPort = ":9090"
+
+// controlTokenMagic starts the message authenticated by the tokens of the
+// control API.
+const controlTokenMagic = "goben-control"
+
+// controlTokenWindow is how far the timestamp of a token may be from the
+// agent clock. Nonces are remembered for twice as long, so a token cannot be
+// replayed.
+const controlTokenWindow = time.Minute
+
+// RunRequest asks an agent to run a client test at StartAt.
+// Config.Secret is not sent, RunAgent derives the request token from it.
+type RunRequest struct {
+	StartAt time.Time
+	Config  Config
+}
+
+// RunResponse is the outcome of a RunRequest.
+type RunResponse struct {
+	Agent    string
+	Result   Result
+	Error    string   `json:",omitempty"`
+	Failures []string `json:",omitempty"` // failed thresholds, see ThresholdError
+}
+
+// agent runs client tests on behalf of a controller, one at a time.
+type agent struct {
+	name    string
+	secret  string // used for the tests of the agent, the controller does not send it
+	mutex   sync.Mutex
+	running bool
+}
+
+func (a *agent) acquire() bool {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if a.running {
+		return false
+	}
+	a.running = true
+	return true
+}
+
+func (a *agent) release() {
+	a.mutex.Lock()
+	a.running = false
+	a.mutex.Unlock()
+}
+
+// ControlAddr returns the listen address of the control API: addresses
+// without host, such as ":9090", listen on localhost only. Other addresses
+// require a secret, since the API can run tests and change limits.
+func ControlAddr(addr, secret string) (string, error) {
+	host, port, errSplit := net.SplitHostPort(addr)
+	if errSplit != nil {
+		return "", errSplit
+	}
+	if host == "" {
+		return net.JoinHostPort("localhost", port), nil
+	}
+	if secret == "" && !isLoopback(host) {
+		return "", fmt.Errorf("control API on %s requires a secret, or a localhost address", addr)
+	}
+	return addr, nil
+}
+
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// controlToken is the Authorization header of a control API request: the
+// hex HMAC-SHA256, keyed by the shared secret, of the request method and URI,
+// a timestamp and a random nonce. The secret itself is never sent, and a
+// token is only valid for one request, once, within controlTokenWindow.
+func controlToken(secret, method, uri string, now time.Time) string {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		log.Printf("controlToken: nonce: %v", err)
+	}
+	ts := strconv.FormatInt(now.Unix(), 10)
+	n := hex.EncodeToString(nonce)
+	return "Goben " + ts + ":" + n + ":" + controlMAC(secret, method, uri, ts, n)
+}
+
+func controlMAC(secret, method, uri, ts, nonce string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strings.Join([]string{controlTokenMagic, method, uri, ts, nonce}, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// tokenChecker validates control tokens and remembers their nonces.
+type tokenChecker struct {
+	secret string
+	mutex  sync.Mutex
+	seen   map[string]time.Time // nonce => time seen
+}
+
+func (c *tokenChecker) check(r *http.Request, now time.Time) error {
+	token := r.Header.Get("Authorization")
+	if !strings.HasPrefix(token, "Goben ") {
+		return fmt.Errorf("missing token")
+	}
+	fields := strings.Split(strings.TrimPrefix(token, "Goben "), ":")
+	if len(fields) != 3 || fields[1] == "" || len(fields[1]) > 64 {
+		return fmt.Errorf("malformed token")
+	}
+	ts, nonce, mac := fields[0], fields[1], fields[2]
+
+	want := controlMAC(c.secret, r.Method, r.URL.RequestURI(), ts, nonce)
+	if !hmac.Equal([]byte(mac), []byte(want)) {
+		return fmt.Errorf("wrong token")
+	}
+
+	sec, errTs := strconv.ParseInt(ts, 10, 64)
+	if errTs != nil {
+		return fmt.Errorf("malformed token timestamp")
+	}
+	skew := now.Sub(time.Unix(sec, 0))
+	if skew < -controlTokenWindow || skew > controlTokenWindow {
+		return fmt.Errorf("stale token: clock skew %v, limit %v", skew, controlTokenWindow)
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for n, t := range c.seen {
+		if now.Sub(t) > 2*controlTokenWindow {
+			delete(c.seen, n)
+		}
+	}
+	if _, found := c.seen[nonce]; found {
+		return fmt.Errorf("replayed token")
+	}
+	if c.seen == nil {
+		c.seen = map[string]time.Time{}
+	}
+	c.seen[nonce] = now
+	return nil
+}
+
+// requireToken refuses requests without a valid token of secret, see
+// controlToken. Without secret, the API listens on localhost only, see
+// ControlAddr.
+func requireToken(secret string, h http.Handler) http.Handler {
+	if secret == "" {
+		return h
+	}
+	c := &tokenChecker{secret: secret}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := c.check(r, time.Now()); err != nil {
+			log.Printf("control: unauthorized request from %s: %s %s: %v", r.RemoteAddr, r.Method, r.URL.Path, err)
+			w.Header().Set("WWW-Authenticate", "Goben")
+			http.Error(w, "unauthorized: "+err.Error(), http.StatusUnauthorized)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// serveControl runs the HTTP control API on app.Control.
+func serveControl(app *Config, state *serverState) {
+	hostname, _ := os.Hostname()
+	a := &agent{name: hostname + app.Control, secret: app.Secret}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/v1/run", a.handleRun)
+	mux.HandleFunc("/v1/sessions", state.handleSessions)
+	mux.HandleFunc("/v1/sessions/", state.handleKick)
+	mux.HandleFunc("/v1/results", state.handleResults)
+	mux.HandleFunc("/v1/limits", state.handleLimits)
+	mux.HandleFunc("/v1/status", state.handleStatus)
+
+	log.Printf("serveControl: control API listening on: %s", app.Control)
+
+	if err := http.ListenAndServe(app.Control, requireToken(app.Secret, mux)); err != nil {
+		log.Printf("serveControl: %s: %v", app.Control, err)
+	}
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	if errEnc := enc.Encode(v); errEnc != nil {
+		log.Printf("control: sending response: %v", errEnc)
+	}
+}
+
+// handleSessions lists active sessions: GET /v1/sessions
+func (st *serverState) handleSessions(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, st.list())
+}
+
+// handleKick ends a session: DELETE /v1/sessions/{id}
+func (st *serverState) handleKick(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodDelete {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	id, errID := strconv.Atoi(strings.TrimPrefix(r.URL.Path, "/v1/sessions/"))
+	if errID != nil {
+		http.Error(w, fmt.Sprintf("bad session id: %v", errID), http.StatusBadRequest)
+		return
+	}
+	log.Printf("control: kick session %d from %s", id, r.RemoteAddr)
+	if !st.kickSession(id) {
+		http.Error(w, fmt.Sprintf("session %d not found", id), http.StatusNotFound)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// handleResults lists recently finished sessions: GET /v1/results
+func (st *serverState) handleResults(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, st.recent())
+}
+
+// handleStatus shows session and rejection counters: GET /v1/status
+func (st *serverState) handleStatus(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, st.status())
+}
+
+// handleLimits shows or replaces limits: GET or PUT /v1/limits
+func (st *serverState) handleLimits(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPut:
+		var l Limits
+		if errDec := json.NewDecoder(r.Body).Decode(&l); errDec != nil {
+			http.Error(w, fmt.Sprintf("bad limits: %v", errDec), http.StatusBadRequest)
+			return
+		}
+		if errLimits := l.validate(); errLimits != nil {
+			http.Error(w, fmt.Sprintf("bad limits: %v", errLimits), http.StatusBadRequest)
+			return
+		}
+		log.Printf("control: limits from %s", r.RemoteAddr)
+		st.setLimits(l)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	writeJSON(w, st.getLimits())
+}
+
+func (a *agent) handleRun(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	var req RunRequest
+	if errDec := json.NewDecoder(r.Body).Decode(&req); errDec != nil {
+		http.Error(w, fmt.Sprintf("bad run request: %v", errDec), http.StatusBadRequest)
+		return
+	}
+
+	if len(req.Config.Hosts) == 0 {
+		http.Error(w, "bad run request: missing hosts", http.StatusBadRequest)
+		return
+	}
+
+	if !a.acquire() {
+		http.Error(w, "agent busy: a test is already running", http.StatusConflict)
+		return
+	}
+	defer a.release()
+
+	log.Printf("control: run from %s: hosts=%q startAt=%v", r.RemoteAddr, req.Config.Hosts, req.StartAt)
+
+	if wait := time.Until(req.StartAt); wait > 0 {
+		log.Printf("control: starting in %v", wait)
+		time.Sleep(wait)
+	} else if !req.StartAt.IsZero() {
+		log.Printf("control: late start by %v", -wait)
+	}
+
+	req.Config.Secret = a.secret
+	localOnly(&req.Config)
+
+	result, errRun := BuildClient(&req.Config)
+
+	resp := RunResponse{Agent: a.name, Result: result}
+	if errRun != nil {
+		resp.Error = errRun.Error()
+		if th, isThreshold := errRun.(*ThresholdError); isThreshold {
+			resp.Failures = th.Failures
+		}
+	}
+
+	writeJSON(w, &resp)
+}
+
+// localOnly clears the parts of a client config posted to an agent which
+// name local files: results go back to the controller, which must not make
+// the agent write or read its files.
+func localOnly(cfg *Config) {
+	if cfg.Export != "" || cfg.Csv != "" || cfg.JSON != "" || cfg.Chart != "" {
+		log.Printf("control: ignoring export files of run request: export=%q csv=%q json=%q chart=%q", cfg.Export, cfg.Csv, cfg.JSON, cfg.Chart)
+	}
+	cfg.Export = ""
+	cfg.Csv = ""
+	cfg.JSON = ""
+	cfg.Chart = ""
+	cfg.ASCII = false
+	cfg.PayloadFile = "" // the payload travels in Opt.PayloadData
+	cfg.TLSCert = ""
+	cfg.TLSKey = ""
+	cfg.Listeners = nil
+	cfg.Control = ""
+}
+
+// RunAgent posts req to the control API of agent and waits for the test result.
+func RunAgent(agentAddr string, req RunRequest) (RunResponse, error) {
+	var resp RunResponse
+
+	body, errEnc := json.Marshal(&req)
+	if errEnc != nil {
+		return resp, errEnc
+	}
+
+	url := "http://" + appendPortIfMissing(agentAddr, defaultControlPort) + "/v1/run"
+
+	post, errReq := http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if errReq != nil {
+		return resp, errReq
+	}
+	post.Header.Set("Content-Type", "application/json")
+	if req.Config.Secret != "" {
+		post.Header.Set("Authorization", controlToken(req.Config.Secret, post.Method, post.URL.RequestURI(), time.Now()))
+	}
+
+	r, errPost := http.DefaultClient.Do(post)
+	if errPost != nil {
+		return resp, errPost
+	}
+	defer r.Body.Close()
+
+	if r.StatusCode != http.StatusOK {
+		msg, _ := ioutil.ReadAll(r.Body)
+		return resp, fmt.Errorf("%s: %s: %s", url, r.Status, bytes.TrimSpace(msg))
+	}
+
+	if errDec := json.NewDecoder(r.Body).Decode(&resp); errDec != nil {
+		return resp, fmt.Errorf("%s: %v", url, errDec)
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,121 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestControlAddr(t *testing.T) {
+	table := []struct {
+		addr   string
+		secret string
+		want   string
+	}{
+		{":9090", "", "localhost:9090"},
+		{"127.0.0.1:9090", "", "127.0.0.1:9090"},
+		{"[::1]:9090", "", "[::1]:9090"},
+		{"0.0.0.0:9090", "s", "0.0.0.0:9090"},
+	}
+	for _, d := range table {
+		addr, err := ControlAddr(d.addr, d.secret)
+		if err != nil || addr != d.want {
+			t.Errorf("ControlAddr(%q): addr=%q err=%v wanted=%q", d.addr, addr, err, d.want)
+		}
+	}
+
+	for _, bad := range []string{"0.0.0.0:9090", "agent1:9090", "9090"} {
+		if _, err := ControlAddr(bad, ""); err == nil {
+			t.Errorf("ControlAddr(%q): expected error", bad)
+		}
+	}
+}
+
+func TestRequireToken(t *testing.T) {
+	h := requireToken("secret", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+
+	serve := func(method, uri, auth string) int {
+		r := httptest.NewRequest(method, uri, nil)
+		if auth != "" {
+			r.Header.Set("Authorization", auth)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		return w.Code
+	}
+
+	now := time.Now()
+	table := []struct {
+		name string
+		auth string
+	}{
+		{"missing", ""},
+		{"secret", "Bearer secret"},
+		{"malformed", "Goben " + strconv.FormatInt(now.Unix(), 10)},
+		{"other secret", controlToken("other", "GET", "/v1/status", now)},
+		{"other method", controlToken("secret", "DELETE", "/v1/status", now)},
+		{"other path", controlToken("secret", "GET", "/v1/results", now)},
+		{"old", controlToken("secret", "GET", "/v1/status", now.Add(-2*controlTokenWindow))},
+		{"future", controlToken("secret", "GET", "/v1/status", now.Add(2*controlTokenWindow))},
+	}
+	for _, d := range table {
+		if code := serve("GET", "/v1/status", d.auth); code != http.StatusUnauthorized {
+			t.Errorf("requireToken: %s token: status=%d wanted=%d", d.name, code, http.StatusUnauthorized)
+		}
+	}
+
+	token := controlToken("secret", "GET", "/v1/status", now)
+	if code := serve("GET", "/v1/status", token); code != http.StatusOK {
+		t.Errorf("requireToken: valid token: status=%d wanted=%d", code, http.StatusOK)
+	}
+	if code := serve("GET", "/v1/status", token); code != http.StatusUnauthorized {
+		t.Errorf("requireToken: replayed token: status=%d wanted=%d", code, http.StatusUnauthorized)
+	}
+	if code := serve("GET", "/v1/status", controlToken("secret", "GET", "/v1/status", now)); code != http.StatusOK {
+		t.Errorf("requireToken: second token: status=%d wanted=%d", code, http.StatusOK)
+	}
+}
+
+func TestRunIgnoresExportFiles(t *testing.T) {
+	addr := testServer(t)
+
+	dir, errDir := ioutil.TempDir("", "goben-agent")
+	if errDir != nil {
+		t.Fatal(errDir)
+	}
+	defer os.RemoveAll(dir)
+
+	cfg := testClientConfig(addr)
+	cfg.Export = filepath.Join(dir, "export-%d-%s.yaml")
+	cfg.JSON = filepath.Join(dir, "export-%d-%s.json")
+	cfg.Csv = filepath.Join(dir, "export-%d-%s.csv")
+	cfg.Chart = filepath.Join(dir, "chart-%d-%s.png")
+	body, errEnc := json.Marshal(RunRequest{Config: cfg})
+	if errEnc != nil {
+		t.Fatal(errEnc)
+	}
+
+	a := &agent{name: "test"}
+	w := httptest.NewRecorder()
+	a.handleRun(w, httptest.NewRequest(http.MethodPost, "/v1/run", bytes.NewReader(body)))
+
+	var resp RunResponse
+	if errDec := json.NewDecoder(w.Body).Decode(&resp); errDec != nil {
+		t.Fatalf("run: status=%d: %v", w.Code, errDec)
+	}
+	if resp.Error != "" || resp.Result.Connected != 1 {
+		t.Errorf("run: error=%q connected=%d", resp.Error, resp.Result.Connected)
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	for _, f := range files {
+		t.Errorf("run: agent wrote file: %s", f.Name())
+	}
+}
@@ -0,0 +1,20 @@
+package lib
+
+import (
+	"log"
+	"time"
+)
+
+// logCPU reports the CPU cost of transferring bytes in elapsed time,
+// from the process CPU times, which include any server in the same process.
+func logCPU(user, system, elapsed time.Duration, bytes int64) {
+	total := user + system
+	var load, perGB float64
+	if elapsed > 0 {
+		load = 100 * total.Seconds() / elapsed.Seconds()
+	}
+	if bytes > 0 {
+		perGB = total.Seconds() / (float64(bytes) / 1e9)
+	}
+	log.Printf("cpu: user %v system %v: %.1f%% of one CPU, %.3f CPU seconds per GB transferred", user, system, load, perGB)
+}
@@ -0,0 +1,13 @@
+//go:build !darwin && !dragonfly && !freebsd && !linux && !netbsd && !openbsd
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd
+
+package lib
+
+import (
+	"time"
+)
+
+// cpuTime is not available on this platform.
+func cpuTime() (user, system time.Duration, ok bool) {
+	return 0, 0, false
+}
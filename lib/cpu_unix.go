@@ -0,0 +1,18 @@
+//go:build darwin || dragonfly || freebsd || linux || netbsd || openbsd
+// +build darwin dragonfly freebsd linux netbsd openbsd
+
+package lib
+
+import (
+	"syscall"
+	"time"
+)
+
+// cpuTime returns the user and system CPU time used by the process so far.
+func cpuTime() (user, system time.Duration, ok bool) {
+	var ru syscall.Rusage
+	if errUsage := syscall.Getrusage(syscall.RUSAGE_SELF, &ru); errUsage != nil {
+		return 0, 0, false
+	}
+	return time.Duration(ru.Utime.Nano()), time.Duration(ru.Stime.Nano()), true
+}
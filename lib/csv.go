@@ -46,7 +46,28 @@ func exportCsv(filename string, info *ExportInfo) error {
 		}
 	}
 
+	if errStats := writeCsvStats(w, "input-stats", info.InputStats); errStats != nil {
+		return errStats
+	}
+
+	if errStats := writeCsvStats(w, "output-stats", info.OutputStats); errStats != nil {
+		return errStats
+	}
+
 	w.Flush()
 
 	return out.Close()
 }
+
+// writeCsvStats appends stats rows, with the stat name in the TIME column.
+func writeCsvStats(w *csv.Writer, dir string, s Stats) error {
+	entry := []string{dir, "", ""}
+	for _, f := range s.statsFields() {
+		entry[Time] = f[0]
+		entry[Rate] = f[1]
+		if err := w.Write(entry); err != nil {
+			return err
+		}
+	}
+	return nil
+}
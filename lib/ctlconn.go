@@ -0,0 +1,442 @@
+package lib
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// Messages on the control connection of a test, see PROTOCOL.md.
+const (
+	ctlStart    = "start"    // client: data connections may start transferring
+	ctlStop     = "stop"     // client: end the test and send results; server: the test was stopped
+	ctlInterval = "interval" // server: bytes transferred during the last report interval
+	ctlResults  = "results"  // server: statistics of the finished data sessions
+)
+
+// ctlMsg is exchanged on the control connection of a test.
+type ctlMsg struct {
+	Type        string
+	Reason      string          `json:",omitempty"` // stop sent by the server
+	Elapsed     time.Duration   `json:",omitempty"` // interval length
+	InputBytes  int64           `json:",omitempty"` // interval: received by the server
+	OutputBytes int64           `json:",omitempty"` // interval: sent by the server
+	Results     []SessionResult `json:",omitempty"`
+}
+
+// ctlWait bounds the wait for data sessions to end after a stop,
+// and the wait for results on the client.
+const ctlWait = 10 * time.Second
+
+// ctlIdleTimeout ends control connections whose test has no running data
+// session and whose client sent nothing for that long.
+const ctlIdleTimeout = 30 * time.Second
+
+// ctlGrace is the time a control connection may outlive the test duration,
+// covering connection setup, the start barrier, draining and results.
+const ctlGrace = time.Minute
+
+// ctlWatchInterval is the period of the idle check.
+const ctlWatchInterval = time.Second
+
+// testCtl is the server side of a test with a control connection.
+// Data sessions attach to it by presenting its cookie.
+type testCtl struct {
+	cookie    string
+	start     chan struct{} // closed by ctlStart
+	startOnce sync.Once
+	kicks     chan int // sessions kicked through the control API
+
+	// guarded by serverState mutex
+	sessions []*session
+	running  int
+	results  []SessionResult
+}
+
+// id is a short form of the cookie for logs, which does not disclose it.
+func (t *testCtl) id() string {
+	return cookieID(t.cookie)
+}
+
+// cookieID is the short form of cookie for logs.
+func cookieID(cookie string) string {
+	if len(cookie) > 8 {
+		return cookie[:8]
+	}
+	return cookie
+}
+
+func (t *testCtl) release() {
+	t.startOnce.Do(func() {
+		close(t.start)
+	})
+}
+
+func (t *testCtl) notifyKick(id int) {
+	select {
+	case t.kicks <- id:
+	default:
+	}
+}
+
+func (st *serverState) newTest() (*testCtl, error) {
+	nonce, errNonce := newNonce()
+	if errNonce != nil {
+		return nil, errNonce
+	}
+	t := &testCtl{
+		cookie: hex.EncodeToString(nonce),
+		start:  make(chan struct{}),
+		kicks:  make(chan int, 1),
+	}
+
+	st.mutex.Lock()
+	st.tests[t.cookie] = t
+	st.mutex.Unlock()
+
+	return t, nil
+}
+
+// test finds the test for a data connection cookie, nil when unknown.
+func (st *serverState) test(cookie string) *testCtl {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	return st.tests[cookie]
+}
+
+// attach adds a data session to test t.
+func (st *serverState) attach(t *testCtl, s *session) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	s.test = t
+	t.sessions = append(t.sessions, s)
+	t.running++
+}
+
+// testBytes sums the bytes received and sent by the sessions of t.
+func (st *serverState) testBytes(t *testCtl) (input, output int64) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	for _, s := range t.sessions {
+		info := s.snapshot()
+		input += info.InputBytes
+		output += info.OutputBytes
+	}
+	return
+}
+
+// stopTest ends the running sessions of t.
+func (st *serverState) stopTest(t *testCtl, reason string) {
+	st.mutex.Lock()
+	var sessions []*session
+	for _, s := range t.sessions {
+		if st.sessions[s.info.ID] == s {
+			sessions = append(sessions, s)
+		}
+	}
+	st.mutex.Unlock()
+
+	for _, s := range sessions {
+		st.stopSession(s, reason)
+	}
+}
+
+// running returns the number of running sessions of t.
+func (st *serverState) running(t *testCtl) int {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	return t.running
+}
+
+// waitRunning waits up to timeout for the sessions of t to end,
+// and returns the number still running.
+func (st *serverState) waitRunning(t *testCtl, timeout time.Duration) int {
+	deadline := time.Now().Add(timeout)
+	for {
+		running := st.running(t)
+
+		if running == 0 || time.Now().After(deadline) {
+			return running
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// waitTest waits up to timeout for the sessions of t to end,
+// then returns their results.
+func (st *serverState) waitTest(t *testCtl, timeout time.Duration) []SessionResult {
+	if running := st.waitRunning(t, timeout); running > 0 {
+		log.Printf("waitTest: test %s: %d session(s) still running", t.id(), running)
+	}
+
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	return append([]SessionResult{}, t.results...)
+}
+
+// endTest forgets the cookie of t and stops its sessions.
+func (st *serverState) endTest(t *testCtl) {
+	st.mutex.Lock()
+	delete(st.tests, t.cookie)
+	st.mutex.Unlock()
+
+	st.stopTest(t, "stopped by control connection end")
+}
+
+// handleControl runs the control connection of a test, after the options.
+func handleControl(app *Config, w wire, conn net.Conn, opt Options, state *serverState) {
+	t, errTest := state.newTest()
+	if errTest != nil {
+		log.Printf("handleControl: %v", errTest)
+		return
+	}
+	defer state.endTest(t)
+
+	a := newAck()
+	a.Cookie = t.cookie
+	if errAck := ackSend(w, conn, a); errAck != nil {
+		log.Printf("handleControl: sending ack: %v", errAck)
+		return
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	log.Printf("handleControl: test %s: control connection: %v", t.id(), conn.RemoteAddr())
+
+	done := make(chan struct{})
+	defer close(done)
+
+	msgs := make(chan ctlMsg)
+	go func() {
+		defer close(msgs)
+		for {
+			var m ctlMsg
+			if errRecv := w.recv(conn, &m); errRecv != nil {
+				if !stopped(done) {
+					log.Printf("handleControl: test %s: receiving: %v", t.id(), errRecv)
+				}
+				return
+			}
+			select {
+			case msgs <- m:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var tick <-chan time.Time
+	if opt.ReportInterval > 0 {
+		ticker := time.NewTicker(opt.ReportInterval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+	prevTime := time.Now()
+	var prevInput, prevOutput int64
+
+	watch := time.NewTicker(ctlWatchInterval)
+	defer watch.Stop()
+	lastActive := time.Now()
+
+	var deadline <-chan time.Time
+	if opt.hasDeadline() {
+		timer := time.NewTimer(opt.testDuration() + ctlGrace)
+		defer timer.Stop()
+		deadline = timer.C
+	}
+
+	// stop tells the client why the server ends the test
+	stop := func(reason string) {
+		log.Printf("handleControl: test %s: %s", t.id(), reason)
+		if errSend := w.send(conn, &ctlMsg{Type: ctlStop, Reason: reason}); errSend != nil {
+			log.Printf("handleControl: test %s: sending stop: %v", t.id(), errSend)
+		}
+	}
+
+	for {
+		select {
+		case m, ok := <-msgs:
+			if !ok {
+				return
+			}
+			lastActive = time.Now()
+			switch m.Type {
+			case ctlStart:
+				log.Printf("handleControl: test %s: start", t.id())
+				t.release()
+			case ctlStop:
+				log.Printf("handleControl: test %s: stop", t.id())
+				// the client half-closed its data connections, let them drain
+				state.waitRunning(t, drainTimeout)
+				state.stopTest(t, "stopped by client")
+				results := state.waitTest(t, ctlWait)
+				if errSend := w.send(conn, &ctlMsg{Type: ctlResults, Results: results}); errSend != nil {
+					log.Printf("handleControl: test %s: sending results: %v", t.id(), errSend)
+				}
+				return
+			default:
+				log.Printf("handleControl: test %s: unexpected message: %q", t.id(), m.Type)
+			}
+		case now := <-tick:
+			input, output := state.testBytes(t)
+			m := ctlMsg{
+				Type:        ctlInterval,
+				Elapsed:     now.Sub(prevTime),
+				InputBytes:  input - prevInput,
+				OutputBytes: output - prevOutput,
+			}
+			prevTime, prevInput, prevOutput = now, input, output
+			if errSend := w.send(conn, &m); errSend != nil {
+				log.Printf("handleControl: test %s: sending interval: %v", t.id(), errSend)
+				return
+			}
+		case now := <-watch.C:
+			if state.running(t) > 0 {
+				lastActive = now
+			} else if now.Sub(lastActive) > ctlIdleTimeout {
+				stop(fmt.Sprintf("control connection idle for %v", ctlIdleTimeout))
+				return
+			}
+		case <-deadline:
+			stop(fmt.Sprintf("test duration %v exceeded by %v", opt.testDuration(), ctlGrace))
+			return
+		case id := <-t.kicks:
+			m := ctlMsg{Type: ctlStop, Reason: fmt.Sprintf("session %d kicked by server", id)}
+			if errSend := w.send(conn, &m); errSend != nil {
+				log.Printf("handleControl: test %s: sending stop: %v", t.id(), errSend)
+				return
+			}
+		}
+	}
+}
+
+// ctlClient is the client side of a test control connection.
+type ctlClient struct {
+	host    string
+	conn    net.Conn
+	w       wire
+	cookie  string
+	unit    Unit
+	mutex   sync.Mutex // serializes sends
+	results chan []SessionResult
+}
+
+// openControl opens the control connection of the test with the single
+// host in hc, dialing with the timeout and retries of data connections.
+// It returns nil when the test runs without control connection, as with
+// servers predating it.
+func openControl(hc *Config) *ctlClient {
+	cfg := *hc
+	cfg.UDP = false // UDP tests are controlled over TCP
+
+	host := cfg.Hosts[0]
+	hh := appendPortIfMissing(host, cfg.DefaultPort)
+
+	dialer := newDialer(&cfg, "tcp")
+
+	var conn net.Conn
+	for attempt := 0; ; attempt++ {
+		var errDial error
+		conn, _, errDial = dialConnection(&cfg, dialer, "tcp", hh)
+		if errDial == nil {
+			break
+		}
+		log.Printf("openControl: %s: attempt=%d: %v", hh, attempt, errDial)
+		if attempt >= cfg.ConnectRetries {
+			return nil
+		}
+		time.Sleep(cfg.ConnectRetryDelay)
+	}
+
+	conn.SetDeadline(handshakeDeadline(&cfg))
+
+	opt := cfg.Opt
+	opt.Control = true
+	opt.Features = append(append([]string{}, opt.Features...), featureControl)
+
+	a, errHandshake := handshake(&cfg, conn, opt)
+	if a != nil && len(missingFeatures([]string{featureControl}, a.Features)) > 0 {
+		log.Printf("openControl: %s: server protocol version %d lacks control connection, using legacy protocol", hh, a.Version)
+		conn.Close()
+		return nil
+	}
+	if errHandshake != nil {
+		log.Printf("openControl: %s: %v", hh, errHandshake)
+		conn.Close()
+		return nil
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	log.Printf("openControl: %s: control connection established", hh)
+
+	cc := &ctlClient{
+		host:    host,
+		conn:    conn,
+		w:       newWire(cfg.Wire, false),
+		cookie:  a.Cookie,
+		unit:    cfg.Unit.orDefault(),
+		results: make(chan []SessionResult, 1),
+	}
+
+	go cc.reader()
+
+	return cc
+}
+
+func (cc *ctlClient) send(m ctlMsg) error {
+	cc.mutex.Lock()
+	defer cc.mutex.Unlock()
+	return cc.w.send(cc.conn, &m)
+}
+
+// reader logs server intervals and stops, until the results arrive.
+func (cc *ctlClient) reader() {
+	defer close(cc.results)
+	for {
+		var m ctlMsg
+		if errRecv := cc.w.recv(cc.conn, &m); errRecv != nil {
+			log.Printf("control: %s: receiving: %v", cc.host, errRecv)
+			return
+		}
+		switch m.Type {
+		case ctlInterval:
+			sec := m.Elapsed.Seconds()
+			if sec <= 0 {
+				continue
+			}
+			log.Printf("control: %s server interval: input %.3f %s output %.3f %s", cc.host,
+				cc.unit.scale(float64(8*m.InputBytes)/sec), cc.unit,
+				cc.unit.scale(float64(8*m.OutputBytes)/sec), cc.unit)
+		case ctlStop:
+			log.Printf("control: %s: server stopped the test: %s", cc.host, m.Reason)
+		case ctlResults:
+			cc.results <- m.Results
+			return
+		default:
+			log.Printf("control: %s: unexpected message: %q", cc.host, m.Type)
+		}
+	}
+}
+
+// finish ends the test on the server and returns its results.
+func (cc *ctlClient) finish() ([]SessionResult, error) {
+	defer cc.conn.Close()
+
+	if errStop := cc.send(ctlMsg{Type: ctlStop}); errStop != nil {
+		return nil, fmt.Errorf("sending stop: %v", errStop)
+	}
+
+	select {
+	case results, ok := <-cc.results:
+		if !ok {
+			return nil, fmt.Errorf("control connection lost before results")
+		}
+		return results, nil
+	case <-time.After(ctlWait + handshakeTimeout):
+		return nil, fmt.Errorf("timeout waiting for results")
+	}
+}
@@ -0,0 +1,59 @@
+package lib
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTestCtl(t *testing.T) {
+	state := newServerState(Limits{})
+
+	tc, errTest := state.newTest()
+	if errTest != nil {
+		t.Fatalf("newTest: %v", errTest)
+	}
+	if state.test(tc.cookie) != tc {
+		t.Errorf("test: cookie not found")
+	}
+	if state.test("unknown") != nil {
+		t.Errorf("test: unknown cookie found")
+	}
+
+	kicked := false
+	s, errBegin := state.begin("TCP", "client:1", Options{}, 1, func() { kicked = true })
+	if errBegin != nil {
+		t.Fatalf("begin: %v", errBegin)
+	}
+	state.attach(tc, s)
+
+	state.stopTest(tc, "stopped by client")
+	if !kicked || !s.stopped() {
+		t.Errorf("stopTest: session not stopped")
+	}
+
+	state.end(s)
+	if results := state.waitTest(tc, time.Second); len(results) != 1 {
+		t.Errorf("waitTest: expected 1 result, got %d", len(results))
+	}
+
+	state.endTest(tc)
+	if state.test(tc.cookie) != nil {
+		t.Errorf("endTest: cookie still valid")
+	}
+}
+
+func TestOptionsStringHidesCookie(t *testing.T) {
+	cookie := "0123456789abcdef0123456789abcdef"
+	opt := Options{Cookie: cookie, PayloadData: make([]byte, 1000)}
+
+	for _, s := range []string{opt.String(), fmt.Sprintf("%v", opt)} {
+		if strings.Contains(s, cookie) {
+			t.Errorf("options log discloses the cookie: %s", s)
+		}
+		if !strings.Contains(s, "01234567...") || !strings.Contains(s, "<1000 bytes>") {
+			t.Errorf("options log: %s", s)
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"time"
+)
+
+// drainTimeout bounds the wait for the peer to finish sending after the
+// local writer stopped, over TCP and TLS.
+const drainTimeout = 5 * time.Second
+
+// udpDrainTimeout is the time to collect datagrams in flight after the
+// local writer stopped, over UDP.
+const udpDrainTimeout = 500 * time.Millisecond
+
+// udpIdleTimeout ends UDP transfer limits without TotalDuration when no
+// datagram arrives, since a lost datagram would otherwise never complete
+// the transfer.
+const udpIdleTimeout = 10 * time.Second
+
+// errTestEnd ends a transfer at the end of the test.
+var errTestEnd = errors.New("end of test")
+
+// endOfTest tells whether err ends a transfer normally: the peer
+// half-closed the connection, or the transfer was stopped locally.
+func endOfTest(err error) bool {
+	if err == io.EOF || errors.Is(err, errTestEnd) {
+		return true
+	}
+	if errNet, isNet := err.(net.Error); isNet && errNet.Timeout() {
+		return true // only drain and idle deadlines are set during transfers
+	}
+	return strings.Contains(err.Error(), "use of closed network connection")
+}
+
+// stopped reports whether stop is closed. A nil stop is never closed.
+func stopped(stop <-chan struct{}) bool {
+	select {
+	case <-stop:
+		return true
+	default:
+	}
+	return false
+}
+
+// closeWrite half-closes TCP and TLS connections, so that the peer reader
+// gets io.EOF after the data in flight. UDP has nothing to close.
+func closeWrite(conn net.Conn) {
+	cw, isCW := conn.(interface{ CloseWrite() error })
+	if !isCW {
+		return
+	}
+	if errClose := cw.CloseWrite(); errClose != nil {
+		log.Printf("closeWrite: %v: %v", conn.RemoteAddr(), errClose)
+	}
+}
+
+// endTransfer stops the writer and half-closes the connection, then lets
+// the reader drain the data in flight until the peer half-closes too.
+// Each step waits at most drain.
+func endTransfer(conn net.Conn, stopWriter, doneReader, doneWriter chan struct{}, drain time.Duration) {
+	close(stopWriter)
+	conn.SetWriteDeadline(time.Now().Add(drain))
+	<-doneWriter
+	closeWrite(conn)
+	conn.SetReadDeadline(time.Now().Add(drain))
+	<-doneReader
+}
+
+// idleReader ends the reads of f from conn after idle without data.
+func idleReader(conn net.Conn, f call, idle time.Duration) call {
+	return func(b []byte) (int, error) {
+		conn.SetReadDeadline(time.Now().Add(idle))
+		n, err := f(b)
+		if errNet, isNet := err.(net.Error); isNet && errNet.Timeout() {
+			return n, fmt.Errorf("idle for %v: %w", idle, errTestEnd)
+		}
+		return n, err
+	}
+}
@@ -0,0 +1,26 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func TestEndOfTest(t *testing.T) {
+	ends := []error{
+		io.EOF,
+		errTestEnd,
+		fmt.Errorf("udpWriteTo: kicked: %w", errTestEnd),
+		errors.New("read tcp 127.0.0.1:8080->127.0.0.1:4000: use of closed network connection"),
+	}
+	for _, err := range ends {
+		if !endOfTest(err) {
+			t.Errorf("endOfTest: %v: expected end of test", err)
+		}
+	}
+
+	if err := errors.New("read: connection reset by peer"); endOfTest(err) {
+		t.Errorf("endOfTest: %v: expected error", err)
+	}
+}
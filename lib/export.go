@@ -1,6 +1,7 @@
 package lib
 
 import (
+	"encoding/json"
 	"os"
 
 	"gopkg.in/yaml.v2"
@@ -23,3 +24,17 @@ func export(filename string, info *ExportInfo) error {
 
 	return errWrite
 }
+
+func exportJSON(filename string, info *ExportInfo) error {
+
+	out, errCreate := os.Create(filename)
+	if errCreate != nil {
+		return errCreate
+	}
+	defer out.Close()
+
+	enc := json.NewEncoder(out)
+	enc.SetIndent("", "  ")
+
+	return enc.Encode(info)
+}
@@ -0,0 +1,119 @@
+package lib
+
+import (
+	"fmt"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// hostOverrides lists the settings a -hosts entry may override with
+// query syntax: host[:port]?connections=8&maxSpeed=500&udp=true
+var hostOverrides = map[string]func(hc *Config, value string) error{
+	"connections": func(hc *Config, value string) error {
+		n, err := strconv.Atoi(value)
+		if err == nil && n < 1 {
+			err = fmt.Errorf("must be at least 1")
+		}
+		hc.Connections = n
+		return err
+	},
+	"maxSpeed": func(hc *Config, value string) (err error) {
+		hc.Opt.MaxSpeed, err = strconv.ParseFloat(value, 64)
+		return
+	},
+	"udp": func(hc *Config, value string) (err error) {
+		hc.UDP, err = strconv.ParseBool(value)
+		return
+	},
+	"tls": func(hc *Config, value string) (err error) {
+		hc.TLS, err = strconv.ParseBool(value)
+		return
+	},
+	"tcpReadSize":  intOverride(func(hc *Config) *int { return &hc.Opt.TCPReadSize }),
+	"tcpWriteSize": intOverride(func(hc *Config) *int { return &hc.Opt.TCPWriteSize }),
+	"udpReadSize":  intOverride(func(hc *Config) *int { return &hc.Opt.UDPReadSize }),
+	"udpWriteSize": intOverride(func(hc *Config) *int { return &hc.Opt.UDPWriteSize }),
+	"connectTimeout": func(hc *Config, value string) (err error) {
+		hc.ConnectTimeout, err = time.ParseDuration(value)
+		return
+	},
+	"connectRetries": func(hc *Config, value string) (err error) {
+		hc.ConnectRetries, err = strconv.Atoi(value)
+		return
+	},
+	"totalBytes": func(hc *Config, value string) (err error) {
+		hc.Opt.TotalBytes, err = strconv.ParseInt(value, 10, 64)
+		return
+	},
+	"totalPackets": func(hc *Config, value string) (err error) {
+		hc.Opt.TotalPackets, err = strconv.ParseInt(value, 10, 64)
+		return
+	},
+}
+
+func intOverride(field func(hc *Config) *int) func(hc *Config, value string) error {
+	return func(hc *Config, value string) error {
+		n, err := strconv.Atoi(value)
+		if err == nil && n < 1 {
+			err = fmt.Errorf("must be positive")
+		}
+		*field(hc) = n
+		return err
+	}
+}
+
+// hostConfig returns a copy of app for a single -hosts entry,
+// with the entry overrides applied and Hosts holding only the address.
+func hostConfig(app *Config, entry string) (*Config, error) {
+	hc := *app
+
+	addr := entry
+	var query string
+	if i := strings.IndexByte(entry, '?'); i >= 0 {
+		addr, query = entry[:i], entry[i+1:]
+	}
+	if addr == "" {
+		return nil, fmt.Errorf("host %q: missing address", entry)
+	}
+	hc.Hosts = hostList{addr}
+
+	values, errQuery := url.ParseQuery(query)
+	if errQuery != nil {
+		return nil, fmt.Errorf("host %q: %v", entry, errQuery)
+	}
+
+	var keys []string
+	for k := range values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		override, found := hostOverrides[k]
+		if !found {
+			return nil, fmt.Errorf("host %q: unknown option %q", entry, k)
+		}
+		v := values[k]
+		if errOverride := override(&hc, v[len(v)-1]); errOverride != nil {
+			return nil, fmt.Errorf("host %q: %s=%q: %v", entry, k, v[len(v)-1], errOverride)
+		}
+	}
+
+	return &hc, nil
+}
+
+// hostConfigs expands app.Hosts into one config per host.
+func hostConfigs(app *Config) ([]*Config, error) {
+	var hosts []*Config
+	for _, h := range app.Hosts {
+		hc, err := hostConfig(app, h)
+		if err != nil {
+			return nil, err
+		}
+		hosts = append(hosts, hc)
+	}
+	return hosts, nil
+}
@@ -0,0 +1,30 @@
+package lib
+
+import (
+	"testing"
+)
+
+func TestHostConfig(t *testing.T) {
+	app := &Config{Connections: 1, TLS: true}
+	app.Opt.MaxSpeed = 100
+
+	hc, err := hostConfig(app, "host1:9000?connections=8&maxSpeed=500&udp=true")
+	if err != nil {
+		t.Fatalf("hostConfig: %v", err)
+	}
+	if len(hc.Hosts) != 1 || hc.Hosts[0] != "host1:9000" {
+		t.Errorf("hostConfig: hosts=%q wanted=[host1:9000]", hc.Hosts)
+	}
+	if hc.Connections != 8 || hc.Opt.MaxSpeed != 500 || !hc.UDP || !hc.TLS {
+		t.Errorf("hostConfig: connections=%d maxSpeed=%v udp=%v tls=%v", hc.Connections, hc.Opt.MaxSpeed, hc.UDP, hc.TLS)
+	}
+	if app.Connections != 1 || app.Opt.MaxSpeed != 100 || app.UDP {
+		t.Errorf("hostConfig: base config modified")
+	}
+
+	for _, bad := range []string{"?udp=true", "host?connections=0", "host?udp=maybe", "host?color=red"} {
+		if _, err := hostConfig(app, bad); err == nil {
+			t.Errorf("hostConfig: host=%q: expected error", bad)
+		}
+	}
+}
@@ -1,26 +1,64 @@
 package lib
 
 import (
-	"bytes"
-	"encoding/gob"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
 	"fmt"
 	"io"
 	"log"
 )
 
 type ack struct {
-	Magic string
-	Table map[string]string // send optional information server->client
+	Magic  string
+	Table  map[string]string // send optional information server->client
+	Reject string            // reason for refusing the test, empty when accepted
+	Nonce  []byte            // authentication challenge, answered with authMsg
+
+	Version  int      // server protocol version, see ProtocolVersion
+	Features []string // features supported by the server
+	Cookie   string   // test identifier for data connections, sent on control connections
 }
 
 const ackMagic = "goben-ack"
 
 func newAck() ack {
-	return ack{Magic: ackMagic}
+	return ack{Magic: ackMagic, Version: ProtocolVersion, Features: serverFeatures}
+}
+
+// authMsg answers the ack Nonce with an HMAC keyed by the shared secret,
+// so that the secret is never sent.
+type authMsg struct {
+	Magic string
+	MAC   []byte
+}
+
+const authMagic = "goben-auth"
+
+// nonceSize is the length of the authentication challenge, in bytes.
+const nonceSize = 32
+
+func newNonce() ([]byte, error) {
+	nonce := make([]byte, nonceSize)
+	_, err := rand.Read(nonce)
+	return nonce, err
+}
+
+// authMAC computes HMAC-SHA256 of nonce keyed by secret.
+func authMAC(secret string, nonce []byte) []byte {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(authMagic))
+	mac.Write(nonce)
+	return mac.Sum(nil)
+}
+
+// authValid checks m against the challenge nonce.
+func authValid(secret string, nonce []byte, m authMsg) bool {
+	return m.Magic == authMagic && hmac.Equal(m.MAC, authMAC(secret, nonce))
 }
 
 // ackSend server sends
-func ackSend(udp bool, conn io.Writer, a ack) error {
+func ackSend(w wire, conn io.Writer, a ack) error {
 
 	// prevent sending wrong magic
 	if a.Magic != ackMagic {
@@ -29,43 +67,20 @@ func ackSend(udp bool, conn io.Writer, a ack) error {
 		return fmt.Errorf(m)
 	}
 
-	if udp {
-		var buf bytes.Buffer
-		enc := gob.NewEncoder(&buf)
-		if errEnc := enc.Encode(&a); errEnc != nil {
-			log.Printf("ackSend: UDP encoding: %v", errEnc)
-			return errEnc
-		}
-		_, errWrite := conn.Write(buf.Bytes())
-		if errWrite != nil {
-			log.Printf("ackSend: UDP write: %v", errWrite)
-			return errWrite
-		}
-		return nil
-	}
-
-	enc := gob.NewEncoder(conn)
-	if errEnc := enc.Encode(&a); errEnc != nil {
-		log.Printf("ackSend: TCP failure: %v", errEnc)
-		return errEnc
+	if errSend := w.send(conn, &a); errSend != nil {
+		log.Printf("ackSend: %v", errSend)
+		return errSend
 	}
 
 	return nil
 }
 
 // ackRecv client receives
-func ackRecv(udp bool, conn io.Reader, a *ack) error {
+func ackRecv(w wire, conn io.Reader, a *ack) error {
 
-	if udp {
-		m := fmt.Sprintf("ackRecv: UDP FIXME WRITEME")
-		log.Print(m)
-		return fmt.Errorf(m)
-	}
-
-	dec := gob.NewDecoder(conn)
-	if errDec := dec.Decode(a); errDec != nil {
-		log.Printf("ackRecv: TCP failure: %v", errDec)
-		return errDec
+	if errRecv := w.recv(conn, a); errRecv != nil {
+		log.Printf("ackRecv: %v", errRecv)
+		return errRecv
 	}
 
 	// prevent receiving wrong magic
@@ -77,3 +92,36 @@ func ackRecv(udp bool, conn io.Reader, a *ack) error {
 
 	return nil
 }
+
+// startMagic is sent by the client on every TCP connection once all
+// connections completed the handshake, when Options.SyncStart is set.
+// It is not framed, whatever the wire format.
+const startMagic = "goben-start"
+
+func startSend(conn io.Writer) error {
+	_, err := io.WriteString(conn, startMagic)
+	return err
+}
+
+func startRecv(conn io.Reader) error {
+	buf := make([]byte, len(startMagic))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		return err
+	}
+	if string(buf) != startMagic {
+		return fmt.Errorf("startRecv: bad magic: expected=[%s] got=[%q]", startMagic, buf)
+	}
+	return nil
+}
+
+// exactReader keeps gob from wrapping the connection in a bufio.Reader,
+// which would swallow test data following the handshake message.
+type exactReader struct {
+	io.Reader
+}
+
+func (r exactReader) ReadByte() (byte, error) {
+	var b [1]byte
+	_, err := io.ReadFull(r.Reader, b[:])
+	return b[0], err
+}
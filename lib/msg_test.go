@@ -0,0 +1,25 @@
+package lib
+
+import (
+	"testing"
+)
+
+func TestAuthValid(t *testing.T) {
+	nonce, errNonce := newNonce()
+	if errNonce != nil {
+		t.Fatalf("newNonce: %v", errNonce)
+	}
+
+	m := authMsg{Magic: authMagic, MAC: authMAC("secret", nonce)}
+	if !authValid("secret", nonce, m) {
+		t.Errorf("authValid: matching secret rejected")
+	}
+	if authValid("other", nonce, m) {
+		t.Errorf("authValid: wrong secret accepted")
+	}
+
+	other, _ := newNonce()
+	if authValid("secret", other, m) {
+		t.Errorf("authValid: answer to another nonce accepted")
+	}
+}
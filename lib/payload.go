@@ -0,0 +1,91 @@
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+)
+
+// Payload modes for test data written by clients and servers.
+const (
+	PayloadRandom       = "random"       // incompressible random bytes, the default
+	PayloadZeros        = "zeros"        // all zero bytes
+	PayloadCompressible = "compressible" // random bytes diluted with zeros, see Options.PayloadRatio
+	PayloadFile         = "file"         // repeated contents of a file, see Options.PayloadData
+)
+
+// MaxPayloadFile bounds the file sent in Options with PayloadFile,
+// so that the options still fit in one UDP datagram.
+const MaxPayloadFile = 32 * 1024
+
+// payloadChunk is the period of the compressible payload, small enough for
+// the match window of any compressor.
+const payloadChunk = 256
+
+// payloadData is the file content of PayloadFile. It prints its size only,
+// to keep logged options short.
+type payloadData []byte
+
+func (d payloadData) String() string {
+	return fmt.Sprintf("<%d bytes>", len(d))
+}
+
+// ReadPayloadFile loads the file for PayloadFile.
+func ReadPayloadFile(path string) ([]byte, error) {
+	data, errRead := ioutil.ReadFile(path)
+	if errRead != nil {
+		return nil, errRead
+	}
+	if len(data) == 0 {
+		return nil, fmt.Errorf("empty payload file: %s", path)
+	}
+	if len(data) > MaxPayloadFile {
+		return nil, fmt.Errorf("payload file %s: %d bytes exceeds %d", path, len(data), MaxPayloadFile)
+	}
+	return data, nil
+}
+
+// payloadBuf returns the buffer of size bytes written over and over by a
+// test writer, filled according to opt.Payload.
+func payloadBuf(opt Options, size int) []byte {
+	switch opt.Payload {
+	case "", PayloadRandom:
+		return randBuf(size)
+	case PayloadZeros:
+		return make([]byte, size)
+	case PayloadCompressible:
+		return compressibleBuf(size, opt.PayloadRatio)
+	case PayloadFile:
+		if len(opt.PayloadData) == 0 {
+			log.Printf("payloadBuf: empty payload file, using random payload")
+			return randBuf(size)
+		}
+		buf := make([]byte, size)
+		for i := 0; i < size; i += len(opt.PayloadData) {
+			copy(buf[i:], opt.PayloadData)
+		}
+		return buf
+	}
+	log.Printf("payloadBuf: unknown payload %q, using random payload", opt.Payload)
+	return randBuf(size)
+}
+
+// compressibleBuf fills each chunk with random bytes for 1/ratio of its
+// length, and zeros for the rest, so that it compresses about ratio:1.
+func compressibleBuf(size int, ratio float64) []byte {
+	buf := randBuf(size)
+	if ratio <= 1 {
+		return buf
+	}
+	random := int(payloadChunk / ratio)
+	for i := 0; i < size; i += payloadChunk {
+		end := i + payloadChunk
+		if end > size {
+			end = size
+		}
+		for j := i + random; j < end; j++ {
+			buf[j] = 0
+		}
+	}
+	return buf
+}
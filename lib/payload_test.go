@@ -0,0 +1,44 @@
+package lib
+
+import (
+	"bytes"
+	"compress/flate"
+	"testing"
+)
+
+func compressedSize(t *testing.T, b []byte) int {
+	var out bytes.Buffer
+	w, errWriter := flate.NewWriter(&out, flate.DefaultCompression)
+	if errWriter != nil {
+		t.Fatalf("flate: %v", errWriter)
+	}
+	w.Write(b)
+	w.Close()
+	return out.Len()
+}
+
+func TestPayloadBuf(t *testing.T) {
+	const size = 100000
+
+	if zeros := payloadBuf(Options{Payload: PayloadZeros}, size); !bytes.Equal(zeros, make([]byte, size)) {
+		t.Errorf("payloadBuf: zeros payload not zero")
+	}
+
+	file := []byte("0123456789")
+	buf := payloadBuf(Options{Payload: PayloadFile, PayloadData: file}, 25)
+	if string(buf) != "0123456789012345678901234" {
+		t.Errorf("payloadBuf: file payload: %q", buf)
+	}
+
+	for _, ratio := range []float64{2, 4} {
+		buf := payloadBuf(Options{Payload: PayloadCompressible, PayloadRatio: ratio}, size)
+		got := float64(size) / float64(compressedSize(t, buf))
+		if got < ratio*0.8 || got > ratio*1.2 {
+			t.Errorf("payloadBuf: compressible ratio %v: compressed %.2f:1", ratio, got)
+		}
+	}
+
+	if got := float64(size) / float64(compressedSize(t, payloadBuf(Options{}, size))); got > 1.01 {
+		t.Errorf("payloadBuf: random payload compressed %.2f:1", got)
+	}
+}
@@ -3,26 +3,31 @@ package lib
 import (
 	"fmt"
 	"log"
+	"strings"
 
 	"github.com/guptarohit/asciigraph"
 )
 
 func plotascii(info *ExportInfo, remote string, index int) {
+	plotSeries("Input", info.Input.YValues, info.Unit, remote, index)
+	plotSeries("Output", info.Output.YValues, info.Unit, remote, index)
+}
 
+// plotSeries prints the ASCII chart of one direction. asciigraph needs at
+// least two samples to interpolate, shorter series are skipped.
+func plotSeries(label string, values []float64, unit, remote string, index int) {
 	height := 10
 	width := 70
 
-	if len(info.Input.YValues) > 0 {
-		caption := fmt.Sprintf("Input Mbps: %s Connection %d", remote, index)
-		log.Printf("%s input:", remote)
-		input := asciigraph.Plot(info.Input.YValues, asciigraph.Caption(caption), asciigraph.Height(height), asciigraph.Width(width))
-		fmt.Println(input)
+	if len(values) == 0 {
+		return
 	}
-
-	if len(info.Output.YValues) > 0 {
-		caption := fmt.Sprintf("Output Mbps: %s Connection %d", remote, index)
-		log.Printf("%s output:", remote)
-		output := asciigraph.Plot(info.Output.YValues, asciigraph.Caption(caption), asciigraph.Height(height), asciigraph.Width(width))
-		fmt.Println(output)
+	if len(values) < 2 {
+		log.Printf("%s %s: ASCII chart skipped: %d sample(s)", remote, strings.ToLower(label), len(values))
+		return
 	}
+
+	caption := fmt.Sprintf("%s %s: %s Connection %d", label, unit, remote, index)
+	log.Printf("%s %s:", remote, strings.ToLower(label))
+	fmt.Println(asciigraph.Plot(values, asciigraph.Caption(caption), asciigraph.Height(height), asciigraph.Width(width)))
 }
@@ -0,0 +1,19 @@
+package lib
+
+import (
+	"testing"
+)
+
+func TestPlotasciiShortSeries(t *testing.T) {
+	table := [][]float64{
+		nil,
+		{941.5},
+		{941.5, 938.1},
+	}
+	for _, values := range table {
+		info := &ExportInfo{Unit: "Mbps"}
+		info.Input.YValues = values
+		info.Output.YValues = values
+		plotascii(info, "127.0.0.1:8080", 0) // must not panic
+	}
+}
@@ -0,0 +1,113 @@
+package lib
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// ProtocolVersion is the handshake version sent in Options and ack.
+// Peers predating versioning decode as version 0, with no features.
+const ProtocolVersion = 2
+
+// Protocol features a peer may lack. The client lists the features its test
+// uses in Options, the server lists the features it supports in the ack.
+const (
+	featureAuth          = "auth"          // authentication challenge, acks for UDP
+	featureSyncStart     = "syncStart"     // start message after the ack
+	featureOmit          = "omit"          // server excludes warm-up from its reports
+	featureTransferLimit = "transferLimit" // totalBytes and totalPackets
+	featureControl       = "control"       // control connection, data connections attached by cookie
+	featureVerify        = "verify"        // patterned test data checked by readers
+	featurePayload       = "payload"       // server writes the payload chosen by the client
+	featureZeroCopy      = "zeroCopy"      // server TCP writer uses sendfile
+)
+
+// serverFeatures are the features this server supports.
+var serverFeatures = []string{featureAuth, featureSyncStart, featureOmit, featureTransferLimit, featureControl, featureVerify, featurePayload, featureZeroCopy}
+
+// requiredFeatures break the test when the server ignores them.
+// Other features are downgraded with a warning.
+var requiredFeatures = map[string]bool{
+	featureSyncStart: true,
+	featureVerify:    true,
+}
+
+// usedFeatures lists the features a client needs from the server.
+func (opt Options) usedFeatures() []string {
+	var features []string
+	if opt.Auth {
+		features = append(features, featureAuth)
+	}
+	if opt.SyncStart {
+		features = append(features, featureSyncStart)
+	}
+	if opt.Omit > 0 {
+		features = append(features, featureOmit)
+	}
+	if opt.TotalBytes > 0 || opt.TotalPackets > 0 {
+		features = append(features, featureTransferLimit)
+	}
+	if opt.Verify {
+		features = append(features, featureVerify)
+	}
+	if opt.Payload != "" && opt.Payload != PayloadRandom && !opt.PassiveServer {
+		features = append(features, featurePayload)
+	}
+	if opt.ZeroCopy && !opt.PassiveServer {
+		features = append(features, featureZeroCopy)
+	}
+	return features
+}
+
+// missingFeatures lists the features in want not found in have.
+func missingFeatures(want, have []string) []string {
+	var missing []string
+	for _, w := range want {
+		found := false
+		for _, h := range have {
+			if w == h {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, w)
+		}
+	}
+	return missing
+}
+
+// checkClientFeatures is the server check of options from a client.
+// A newer client may use features unknown to this server.
+func checkClientFeatures(opt Options) error {
+	if opt.Version != ProtocolVersion {
+		log.Printf("checkClientFeatures: client protocol version %d, server %d", opt.Version, ProtocolVersion)
+	}
+	if missing := missingFeatures(opt.Features, serverFeatures); len(missing) > 0 {
+		return fmt.Errorf("unsupported features: %s (server protocol version %d)", strings.Join(missing, ","), ProtocolVersion)
+	}
+	return nil
+}
+
+// checkServerFeatures is the client check of the server ack.
+// It fails when the server lacks a required feature, and warns about
+// features the server will ignore.
+func checkServerFeatures(opt Options, a ack) error {
+	missing := missingFeatures(opt.Features, a.Features)
+
+	var required []string
+	for _, f := range missing {
+		if requiredFeatures[f] {
+			required = append(required, f)
+		} else {
+			log.Printf("checkServerFeatures: server protocol version %d ignores feature: %s", a.Version, f)
+		}
+	}
+
+	if len(required) > 0 {
+		return fmt.Errorf("incompatible server: protocol version %d lacks features: %s", a.Version, strings.Join(required, ","))
+	}
+
+	return nil
+}
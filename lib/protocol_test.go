@@ -0,0 +1,35 @@
+package lib
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCheckServerFeatures(t *testing.T) {
+	opt := Options{SyncStart: true, Omit: time.Second}
+	opt.Features = opt.usedFeatures()
+
+	if errCheck := checkServerFeatures(opt, newAck()); errCheck != nil {
+		t.Errorf("current server: %v", errCheck)
+	}
+
+	legacy := ack{Magic: ackMagic}
+	if errCheck := checkServerFeatures(opt, legacy); errCheck == nil {
+		t.Errorf("legacy server: missing syncStart accepted")
+	}
+
+	opt = Options{Omit: time.Second}
+	opt.Features = opt.usedFeatures()
+	if errCheck := checkServerFeatures(opt, legacy); errCheck != nil {
+		t.Errorf("legacy server: omit not downgraded: %v", errCheck)
+	}
+}
+
+func TestCheckClientFeatures(t *testing.T) {
+	if errCheck := checkClientFeatures(Options{}); errCheck != nil {
+		t.Errorf("legacy client: %v", errCheck)
+	}
+	if errCheck := checkClientFeatures(Options{Version: ProtocolVersion + 1, Features: []string{"future"}}); errCheck == nil {
+		t.Errorf("newer client: unknown feature accepted")
+	}
+}
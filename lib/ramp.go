@@ -0,0 +1,113 @@
+package lib
+
+import (
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// RampStep is the aggregate result of an interval with a constant number of
+// active connections, during ramp-up, hold or ramp-down.
+type RampStep struct {
+	Connections int
+	Start       time.Duration // offset from the first connection start
+	Duration    time.Duration
+	Input       float64 // aggregate reading rate, in report unit
+	Output      float64 // aggregate writing rate, in report unit
+}
+
+func (app *Config) rampEnabled() bool {
+	return app.RampUp > 0 || app.RampDown > 0
+}
+
+// rampDuration is the test duration for the k-th of n connections.
+// Connection k starts at k*RampUp. After the last connection starts, all of
+// them run for TotalDuration, then they stop one every RampDown, the last
+// started stopping first.
+func rampDuration(app *Config, k, n int) time.Duration {
+	return app.Opt.TotalDuration + time.Duration(n-1-k)*(app.RampUp+app.RampDown)
+}
+
+// rampSchedule lists the steps for n connections, skipping empty ones.
+func rampSchedule(app *Config, n int) []RampStep {
+	var steps []RampStep
+
+	add := func(connections int, start, duration time.Duration) {
+		if duration > 0 {
+			steps = append(steps, RampStep{Connections: connections, Start: start, Duration: duration})
+		}
+	}
+
+	for k := 0; k < n-1; k++ {
+		add(k+1, time.Duration(k)*app.RampUp, app.RampUp)
+	}
+
+	hold := time.Duration(n-1) * app.RampUp
+	add(n, hold, app.Opt.testDuration())
+
+	down := hold + app.Opt.testDuration()
+	for j := 1; j < n; j++ {
+		add(n-j, down+time.Duration(j-1)*app.RampDown, app.RampDown)
+	}
+
+	return steps
+}
+
+// rampMonitor measures the aggregate rates of every step in steps.
+// It stops early when done is closed, truncating the current step.
+func rampMonitor(begin time.Time, steps []RampStep, run *clientRun, unit Unit, done <-chan struct{}) []RampStep {
+	var result []RampStep
+
+	prevTime := begin
+	prevIn := atomic.LoadInt64(&run.aggReader.live)
+	prevOut := atomic.LoadInt64(&run.aggWriter.live)
+
+	for _, s := range steps {
+		timer := time.NewTimer(time.Until(begin.Add(s.Start + s.Duration)))
+		finished := false
+		select {
+		case <-timer.C:
+		case <-done:
+			timer.Stop()
+			finished = true
+		}
+
+		now := time.Now()
+		in := atomic.LoadInt64(&run.aggReader.live)
+		out := atomic.LoadInt64(&run.aggWriter.live)
+
+		s.Duration = now.Sub(prevTime)
+		if elapSec := s.Duration.Seconds(); elapSec > 0 {
+			s.Input = unit.scale(float64(8*(in-prevIn)) / elapSec)
+			s.Output = unit.scale(float64(8*(out-prevOut)) / elapSec)
+		}
+		log.Printf("ramp: step %d: connections=%d start=%v duration=%v input=%.3f %s output=%.3f %s",
+			len(result), s.Connections, s.Start, s.Duration, s.Input, unit, s.Output, unit)
+		result = append(result, s)
+
+		if finished {
+			break
+		}
+
+		prevTime = now
+		prevIn = in
+		prevOut = out
+	}
+
+	return result
+}
+
+// logRampPeak reports the step with the highest total rate.
+func logRampPeak(steps []RampStep, unit Unit) {
+	peak := -1
+	for i, s := range steps {
+		if peak < 0 || s.Input+s.Output > steps[peak].Input+steps[peak].Output {
+			peak = i
+		}
+	}
+	if peak < 0 {
+		return
+	}
+	s := steps[peak]
+	log.Printf("ramp: peak at %d connections: input=%.3f %s output=%.3f %s", s.Connections, s.Input, unit, s.Output, unit)
+}
@@ -0,0 +1,38 @@
+package lib
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRampSchedule(t *testing.T) {
+	app := &Config{RampUp: 2 * time.Second, RampDown: time.Second}
+	app.Opt.TotalDuration = 10 * time.Second
+
+	steps := rampSchedule(app, 3)
+
+	expect := []RampStep{
+		{Connections: 1, Start: 0, Duration: 2 * time.Second},
+		{Connections: 2, Start: 2 * time.Second, Duration: 2 * time.Second},
+		{Connections: 3, Start: 4 * time.Second, Duration: 10 * time.Second},
+		{Connections: 2, Start: 14 * time.Second, Duration: time.Second},
+		{Connections: 1, Start: 15 * time.Second, Duration: time.Second},
+	}
+	if len(steps) != len(expect) {
+		t.Fatalf("rampSchedule: steps=%v wanted=%v", steps, expect)
+	}
+	for i := range expect {
+		if steps[i] != expect[i] {
+			t.Errorf("rampSchedule: step %d: %+v wanted=%+v", i, steps[i], expect[i])
+		}
+	}
+
+	// connection k stops at the end of its ramp-down step
+	for k := 0; k < 3; k++ {
+		stop := time.Duration(k)*app.RampUp + rampDuration(app, k, 3)
+		s := expect[len(expect)-1-k]
+		if end := s.Start + s.Duration; stop != end {
+			t.Errorf("rampDuration: connection %d stops at %v wanted=%v", k, stop, end)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package lib
+
+import (
+	"encoding/binary"
+	"sync"
+)
+
+// UDP datagrams carry a small header so the receiver can count losses:
+// 4-byte magic followed by a 8-byte big-endian sequence number.
+const (
+	seqMagic     = 0x67627371 // "gbsq"
+	seqHeaderLen = 12
+)
+
+// stamped reports whether datagram b starts with the sequence header.
+func stamped(b []byte) bool {
+	return len(b) >= seqHeaderLen && binary.BigEndian.Uint32(b) == seqMagic
+}
+
+// seqWriter stamps consecutive sequence numbers into every datagram written by f.
+func seqWriter(f call) call {
+	var seq uint64
+	return func(b []byte) (int, error) {
+		if len(b) >= seqHeaderLen {
+			binary.BigEndian.PutUint32(b, seqMagic)
+			binary.BigEndian.PutUint64(b[4:], seq)
+			seq++
+		}
+		return f(b)
+	}
+}
+
+// seqReader feeds every datagram read by f into t.
+func seqReader(f call, t *seqTracker) call {
+	return func(b []byte) (int, error) {
+		n, err := f(b)
+		if err == nil {
+			t.track(b[:n])
+		}
+		return n, err
+	}
+}
+
+// seqTracker counts received datagrams against the highest sequence seen.
+type seqTracker struct {
+	mutex    sync.Mutex
+	received int64
+	highest  uint64
+}
+
+func (t *seqTracker) track(b []byte) {
+	if !stamped(b) {
+		return // peer does not stamp datagrams
+	}
+	seq := binary.BigEndian.Uint64(b[4:])
+
+	t.mutex.Lock()
+	t.received++
+	if seq > t.highest {
+		t.highest = seq
+	}
+	t.mutex.Unlock()
+}
+
+// loss returns datagrams expected and lost. Datagrams still in flight
+// after the highest sequence seen are not counted.
+// ok is false when no stamped datagram was received.
+func (t *seqTracker) loss() (expected, lost int64, ok bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if t.received == 0 {
+		return 0, 0, false
+	}
+	expected = int64(t.highest) + 1
+	lost = expected - t.received
+	if lost < 0 {
+		lost = 0 // duplicates
+	}
+	return expected, lost, true
+}
+
+func lossPercent(expected, lost int64) float64 {
+	if expected == 0 {
+		return 0
+	}
+	return 100 * float64(lost) / float64(expected)
+}
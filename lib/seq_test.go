@@ -0,0 +1,78 @@
+package lib
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestSeqTrackerLoss(t *testing.T) {
+	table := []struct {
+		name     string
+		seqs     []uint64
+		expected int64
+		lost     int64
+	}{
+		{"in order", []uint64{0, 1, 2, 3, 4}, 5, 0},
+		{"gaps", []uint64{0, 1, 3, 7}, 8, 4},
+		{"first lost", []uint64{1, 2}, 3, 1},
+		{"reordered", []uint64{3, 0, 2, 1}, 4, 0},
+		{"late after gap", []uint64{0, 4, 2, 1}, 5, 1},
+		{"duplicates", []uint64{0, 0, 1, 1, 2, 2}, 3, 0},
+		{"across 32 bits", []uint64{1<<32 - 2, 1<<32 - 1, 1 << 32, 1<<32 + 2}, 1<<32 + 3, 1<<32 + 3 - 4},
+	}
+
+	for _, d := range table {
+		var tr seqTracker
+		for _, s := range d.seqs {
+			tr.track(datagram(s, 100))
+		}
+		expected, lost, ok := tr.loss()
+		if !ok || expected != d.expected || lost != d.lost {
+			t.Errorf("%s: expected=%d lost=%d ok=%v wanted expected=%d lost=%d", d.name, expected, lost, ok, d.expected, d.lost)
+		}
+	}
+}
+
+func TestSeqTrackerNoDatagram(t *testing.T) {
+	var tr seqTracker
+	if _, _, ok := tr.loss(); ok {
+		t.Errorf("no datagram: loss measured")
+	}
+
+	// unstamped or short datagrams from peers which do not stamp
+	tr.track(make([]byte, 100))
+	tr.track(datagram(5, 100)[:seqHeaderLen-1])
+	if _, _, ok := tr.loss(); ok {
+		t.Errorf("unstamped datagrams: loss measured")
+	}
+
+	if p := lossPercent(0, 0); p != 0 {
+		t.Errorf("lossPercent(0, 0): result=%v wanted=0", p)
+	}
+}
+
+func TestSeqWriterReader(t *testing.T) {
+	var tr seqTracker
+	sent := 0
+	w := seqWriter(func(b []byte) (int, error) {
+		sent++
+		if sent%3 == 0 {
+			return len(b), nil // dropped
+		}
+		return seqReader(func(r []byte) (int, error) { return copy(r, b), nil }, &tr)(make([]byte, len(b)))
+	})
+	for i := 0; i < 9; i++ {
+		w(make([]byte, 100))
+	}
+	expected, lost, _ := tr.loss()
+	if expected != 8 || lost != 2 {
+		t.Errorf("writer/reader: expected=%d lost=%d wanted expected=8 lost=2", expected, lost)
+	}
+}
+
+func datagram(seq uint64, size int) []byte {
+	b := make([]byte, size)
+	binary.BigEndian.PutUint32(b, seqMagic)
+	binary.BigEndian.PutUint64(b[4:], seq)
+	return b
+}
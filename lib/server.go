@@ -1,14 +1,13 @@
 package lib
 
 import (
-	"bytes"
 	"crypto/tls"
-	"encoding/gob"
 	"fmt"
 	"log"
 	"net"
 	"os"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -26,16 +25,25 @@ func serve(app *Config) {
 
 	var wg sync.WaitGroup
 
+	state := newServerState(app.Limits)
+
+	if app.Control != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			serveControl(app, state)
+		}()
+	}
+
 	for _, h := range app.Listeners {
 		hh := appendPortIfMissing(h, app.DefaultPort)
-		listenTCP(app, &wg, hh)
-		listenUDP(app, &wg, hh)
+		listenTCP(app, &wg, hh, state)
+		listenUDP(app, &wg, hh, state)
 	}
 
 	wg.Wait()
 }
 
-
 // BuildServer for public func
 func BuildServer(app *Config) {
 	serve(app)
@@ -46,14 +54,14 @@ func fileExists(path string) bool {
 	return err == nil
 }
 
-func listenTCP(app *Config, wg *sync.WaitGroup, h string) {
+func listenTCP(app *Config, wg *sync.WaitGroup, h string, state *serverState) {
 	log.Printf("listenTCP: TLS=%v spawning TCP listener: %s", app.TLS, h)
 
 	// first try TLS
 	if app.TLS {
 		listener, errTLS := listenTLS(app, h)
 		if errTLS == nil {
-			spawnAcceptLoopTCP(app, wg, listener, true)
+			spawnAcceptLoopTCP(app, wg, listener, true, state)
 			return
 		}
 		log.Printf("listenTLS: %v", errTLS)
@@ -65,12 +73,12 @@ func listenTCP(app *Config, wg *sync.WaitGroup, h string) {
 		log.Printf("listenTCP: TLS=%v %s: %v", app.TLS, h, errListen)
 		return
 	}
-	spawnAcceptLoopTCP(app, wg, listener, false)
+	spawnAcceptLoopTCP(app, wg, listener, false, state)
 }
 
-func spawnAcceptLoopTCP(app *Config, wg *sync.WaitGroup, listener net.Listener, isTLS bool) {
+func spawnAcceptLoopTCP(app *Config, wg *sync.WaitGroup, listener net.Listener, isTLS bool, state *serverState) {
 	wg.Add(1)
-	go handleTCP(app, wg, listener, isTLS)
+	go handleTCP(app, wg, listener, isTLS, state)
 }
 
 func listenTLS(app *Config, h string) (net.Listener, error) {
@@ -86,7 +94,7 @@ func listenTLS(app *Config, h string) (net.Listener, error) {
 	return listener, errListen
 }
 
-func listenUDP(app *Config, wg *sync.WaitGroup, h string) {
+func listenUDP(app *Config, wg *sync.WaitGroup, h string, state *serverState) {
 	log.Printf("serve: spawning UDP listener: %s", h)
 
 	udpAddr, errAddr := net.ResolveUDPAddr("udp", h)
@@ -102,7 +110,7 @@ func listenUDP(app *Config, wg *sync.WaitGroup, h string) {
 	}
 
 	wg.Add(1)
-	go handleUDP(app, wg, conn)
+	go handleUDP(app, wg, conn, state)
 }
 
 func appendPortIfMissing(host, port string) string {
@@ -126,48 +134,146 @@ LOOP:
 	return host + port
 }
 
-func handleTCP(app *Config, wg *sync.WaitGroup, listener net.Listener, isTLS bool) {
+func handleTCP(app *Config, wg *sync.WaitGroup, listener net.Listener, isTLS bool, state *serverState) {
 	defer wg.Done()
 
 	var id int
 
-	var aggReader aggregate
-	var aggWriter aggregate
-
 	for {
 		conn, errAccept := listener.Accept()
 		if errAccept != nil {
 			log.Printf("handle: accept: %v", errAccept)
 			break
 		}
-		go handleConnection(conn, id, 0, isTLS, &aggReader, &aggWriter)
+		go handleConnection(app, conn, id, 0, isTLS, state)
 		id++
 	}
 }
 
+// handshakeTimeout bounds the time a TCP client takes to send options.
+const handshakeTimeout = 10 * time.Second
+
+// udpSweepInterval bounds the delay for ending idle or kicked UDP sessions.
+const udpSweepInterval = time.Second
+
+// udpLinger keeps finished UDP sessions in the table, so that late
+// datagrams are not taken for a new session.
+const udpLinger = 10 * time.Second
+
 type udpInfo struct {
 	remote *net.UDPAddr
 	opt    Options
 	acc    *account
+	seq    seqTracker
 	start  time.Time
+	last   time.Time // last datagram of the admitted session
 	id     int
+	s      *session // nil until admitted
+	nonce  []byte   // authentication challenge
+	wire   wire     // handshake format chosen by the client
+	test   *testCtl // control connection of the test, nil for legacy clients
+	done   bool     // finished, ignore further datagrams
+	doneAt time.Time
+}
+
+// udpWriter sends handshake datagrams to a UDP remote.
+type udpWriter struct {
+	conn *net.UDPConn
+	dst  *net.UDPAddr
+}
+
+func (w udpWriter) Write(b []byte) (int, error) {
+	return w.conn.WriteToUDP(b, w.dst)
+}
+
+// challenge sends the authentication nonce.
+func (info *udpInfo) challenge(conn *net.UDPConn) error {
+	nonce, errNonce := newNonce()
+	if errNonce != nil {
+		return errNonce
+	}
+	info.nonce = nonce
+	a := newAck()
+	a.Nonce = nonce
+	return ackSend(info.wire, udpWriter{conn, info.remote}, a)
+}
+
+// refuse ends a test refused before admission. Clients using authentication
+// wait for the reject ack, clients of protocol version 2 and later find it
+// in place of the first test datagram. Older clients get nothing.
+func (info *udpInfo) refuse(conn *net.UDPConn, reason error) {
+	if info.opt.Auth || info.opt.Version >= 2 {
+		a := newAck()
+		a.Reject = reason.Error()
+		if errAck := ackSend(info.wire, udpWriter{conn, info.remote}, a); errAck != nil {
+			log.Printf("handleUDP: sending reject: %v", errAck)
+		}
+	}
+	info.setDone()
 }
 
-func handleUDP(app *Config, wg *sync.WaitGroup, conn *net.UDPConn) {
+// begin admits the session and starts the server writer.
+// Clients using authentication get an ack, legacy clients do not.
+func (info *udpInfo) begin(app *Config, conn *net.UDPConn, state *serverState) {
+	halves := 2
+	if info.opt.PassiveServer {
+		halves = 1
+	}
+
+	a := newAck()
+
+	var errAdmit error
+	info.s, errAdmit = state.begin("UDP", info.remote.String(), info.opt, halves, nil)
+	if errAdmit != nil {
+		log.Printf("handleUDP: refusing %v: %v", info.remote, errAdmit)
+		info.refuse(conn, errAdmit)
+		return
+	}
+	info.opt = info.s.info.Options
+
+	if info.test != nil {
+		state.attach(info.test, info.s)
+	}
+
+	if info.opt.Auth {
+		if errAck := ackSend(info.wire, udpWriter{conn, info.remote}, a); errAck != nil {
+			log.Printf("handleUDP: sending ack: %v", errAck)
+		}
+	}
+
+	info.start = time.Now()
+	info.last = info.start
+	info.acc = newAccount(info.start, app.Unit, info.opt.Omit)
+
+	if !info.opt.PassiveServer {
+		opt := info.opt // copy for gorouting
+		go serverWriterTo(conn, opt, app.Unit, info.remote, info.start, info.id, 0, info.s, state)
+	}
+}
+
+func handleUDP(app *Config, wg *sync.WaitGroup, conn *net.UDPConn, state *serverState) {
 	defer wg.Done()
 
 	tab := map[string]*udpInfo{}
 
 	buf := make([]byte, app.Opt.UDPReadSize)
 
-	var aggReader aggregate
-	var aggWriter aggregate
-
 	var idCount int
 
+	lastSweep := time.Now()
+
 	for {
+		if time.Since(lastSweep) > udpSweepInterval {
+			sweepUDP(tab, state)
+			lastSweep = time.Now()
+		}
+
 		var info *udpInfo
+		conn.SetReadDeadline(time.Now().Add(udpSweepInterval))
 		n, src, errRead := conn.ReadFromUDP(buf)
+		if errNet, isNet := errRead.(net.Error); isNet && errNet.Timeout() {
+			continue
+		}
 		if src == nil {
 			log.Printf("handleUDP: read nil src: error: %v", errRead)
 			continue
@@ -179,29 +285,50 @@ func handleUDP(app *Config, wg *sync.WaitGroup, conn *net.UDPConn) {
 
 			info = &udpInfo{
 				remote: src,
-				acc:    &account{},
 				start:  time.Now(),
 				id:     idCount,
 			}
 			idCount++
-			info.acc.prevTime = info.start
 			tab[src.String()] = info
 
-			dec := gob.NewDecoder(bytes.NewBuffer(buf[:n]))
-			if errOpt := dec.Decode(&info.opt); errOpt != nil {
+			info.wire = detectWire(buf[:n], true)
+			if errOpt := info.wire.decode(buf[:n], &info.opt); errOpt != nil {
 				log.Printf("handleUDP: options failure: %v", errOpt)
+				info.setDone()
 				continue
 			}
-			log.Printf("handleUDP: options received: %v", info.opt)
+			log.Printf("handleUDP: %s options received: %v", info.wire, info.opt)
 
-			if !info.opt.PassiveServer {
-				opt := info.opt // copy for gorouting
-				go serverWriterTo(conn, opt, src, info.acc, info.id, 0, &aggWriter)
+			if errFeatures := checkClientFeatures(info.opt); errFeatures != nil {
+				log.Printf("handleUDP: refusing %v: %v", src, errFeatures)
+				info.refuse(conn, errFeatures)
+				continue
 			}
 
+			if info.opt.Cookie != "" {
+				info.test = state.test(info.opt.Cookie)
+				if info.test == nil {
+					log.Printf("handleUDP: refusing %v: %v", src, errUnknownCookie)
+					info.refuse(conn, errUnknownCookie)
+					continue
+				}
+			} else if app.Secret != "" {
+				if !info.opt.Auth {
+					state.rejectAuth("UDP", src.String(), errAuthRequired)
+					info.refuse(conn, errAuthRequired)
+					continue
+				}
+				if errChallenge := info.challenge(conn); errChallenge != nil {
+					log.Printf("handleUDP: challenge %v: %v", src, errChallenge)
+					info.setDone()
+				}
+				continue
+			}
+
+			info.begin(app, conn, state)
+
 			continue
 		}
-
 		connIndex := fmt.Sprintf("%d/%d", info.id, 0)
 
 		if errRead != nil {
@@ -209,56 +336,293 @@ func handleUDP(app *Config, wg *sync.WaitGroup, conn *net.UDPConn) {
 			continue
 		}
 
-		if time.Since(info.start) > info.opt.TotalDuration {
-			log.Printf("handleUDP: total duration %s timer: %s", info.opt.TotalDuration, src)
-			info.acc.average(info.start, connIndex, "handleUDP", "rcv/s", &aggReader)
-			log.Printf("handleUDP: FIXME: remove idle udp entry from udp table")
+		if info.done {
+			continue
+		}
+
+		if info.s == nil {
+			// answer to the authentication challenge
+			var m authMsg
+			if errDec := info.wire.decode(buf[:n], &m); errDec != nil || !authValid(app.Secret, info.nonce, m) {
+				state.rejectAuth("UDP", src.String(), errAuthFailed)
+				info.refuse(conn, errAuthFailed)
+				continue
+			}
+			log.Printf("handleUDP: authenticated: %v", src)
+			info.begin(app, conn, state)
+			continue
+		}
+
+		if info.expired() {
+			info.finish(state)
 			continue
 		}
 
 		// account read from UDP socket
+		info.last = time.Now()
+		info.seq.track(buf[:n])
+		if info.opt.Verify {
+			info.s.verify.datagram(buf[:n])
+		}
 		info.acc.update(n, info.opt.ReportInterval, connIndex, "handleUDP", "rcv/s", nil)
+		atomic.AddInt64(&info.s.aggReader.live, int64(n))
+
+		if info.acc.limitReached(info.opt.transferLimit(true)) {
+			log.Printf("handleUDP: %s transfer complete: %d bytes %d datagrams in %v: %s",
+				connIndex, info.acc.total, info.acc.totalCalls, time.Since(info.start), src)
+			info.finish(state)
+		}
+	}
+}
+
+// sweepUDP ends expired or kicked sessions which stopped sending,
+// and forgets sessions finished more than udpLinger ago.
+func sweepUDP(tab map[string]*udpInfo, state *serverState) {
+	for key, info := range tab {
+		if !info.done && info.s == nil && time.Since(info.start) > handshakeTimeout {
+			log.Printf("handleUDP: handshake timeout: %s", info.remote)
+			info.setDone()
+			continue
+		}
+		if !info.done && info.expired() {
+			info.finish(state)
+		}
+		if info.done && time.Since(info.doneAt) > udpLinger {
+			delete(tab, key)
+		}
+	}
+}
+
+// expired reports whether the session reached its deadline, was stopped,
+// or, with a transfer limit and no deadline, received nothing for
+// udpIdleTimeout.
+func (info *udpInfo) expired() bool {
+	if info.s.stopped() {
+		log.Printf("handleUDP: %s: %s", info.s.reason, info.remote)
+		return true
+	}
+	if info.opt.hasDeadline() && time.Since(info.start) > info.opt.testDuration() {
+		log.Printf("handleUDP: total duration %s timer: %s", info.opt.testDuration(), info.remote)
+		return true
+	}
+	if !info.opt.hasDeadline() && time.Since(info.last) > udpIdleTimeout {
+		log.Printf("handleUDP: idle for %v: %s", udpIdleTimeout, info.remote)
+		return true
+	}
+	return false
+}
+
+// finish ends the reading half of the session.
+func (info *udpInfo) finish(state *serverState) {
+	connIndex := fmt.Sprintf("%d/%d", info.id, 0)
+	info.acc.average(connIndex, "handleUDP", "rcv/s", &info.s.aggReader)
+	info.logLoss(connIndex)
+	if info.opt.Verify {
+		blocks, corrupted := info.s.verify.result()
+		log.Printf("handleUDP: %s verify: %d/%d datagram(s) corrupted: %s", connIndex, corrupted, blocks, info.remote)
+	}
+	info.setDone()
+	state.end(info.s)
+}
+
+func (info *udpInfo) setDone() {
+	info.done = true
+	info.doneAt = time.Now()
+}
+
+func (info *udpInfo) logLoss(connIndex string) {
+	if expected, lost, ok := info.seq.loss(); ok {
+		log.Printf("handleUDP: %s loss: %.3f%% %d/%d datagrams: %s", connIndex, lossPercent(expected, lost), lost, expected, info.remote)
 	}
 }
 
-func handleConnection(conn net.Conn, c, connections int, isTLS bool, aggReader, aggWriter *aggregate) {
+func handleConnection(app *Config, conn net.Conn, c, connections int, isTLS bool, state *serverState) {
 	defer conn.Close()
 
 	log.Printf("handleConnection: incoming: %s %v", protoLabel(isTLS), conn.RemoteAddr())
 
-	// receive options
+	// a client must complete the handshake in time
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+
+	// receive options, in the wire format chosen by the client
+	w, first, errPeek := peekWire(conn)
+	if errPeek != nil {
+		log.Printf("handleConnection: options failure: %v", errPeek)
+		return
+	}
 	var opt Options
-	dec := gob.NewDecoder(conn)
-	if errOpt := dec.Decode(&opt); errOpt != nil {
-		log.Printf("handleConnection: options failure: %v", errOpt)
+	if errOpt := w.recv(first, &opt); errOpt != nil {
+		log.Printf("handleConnection: options failure: %s: %v", w, errOpt)
 		return
 	}
-	log.Printf("handleConnection: options received: %v", opt)
+	log.Printf("handleConnection: %s options received: %v", w, opt)
 
-	// send ack
 	a := newAck()
-	if errAck := ackSend(false, conn, a); errAck != nil {
+
+	if errFeatures := checkClientFeatures(opt); errFeatures != nil {
+		log.Printf("handleConnection: refusing %v: %v", conn.RemoteAddr(), errFeatures)
+		a.Reject = errFeatures.Error()
+		ackSend(w, conn, a)
+		return
+	}
+
+	// data connections of a test with a control connection present its
+	// cookie, which was given to an authenticated client
+	var t *testCtl
+	if opt.Cookie != "" {
+		t = state.test(opt.Cookie)
+		if t == nil {
+			log.Printf("handleConnection: refusing %v: %v", conn.RemoteAddr(), errUnknownCookie)
+			a.Reject = errUnknownCookie.Error()
+			ackSend(w, conn, a)
+			return
+		}
+	} else if app.Secret != "" {
+		if errAuth := authServer(app.Secret, w, conn, opt); errAuth != nil {
+			state.rejectAuth(protoLabel(isTLS), conn.RemoteAddr().String(), errAuth)
+			a.Reject = errAuth.Error()
+			ackSend(w, conn, a)
+			return
+		}
+		log.Printf("handleConnection: authenticated: %v", conn.RemoteAddr())
+	}
+
+	// control connections are sessions too, counted against the limits
+	s, errAdmit := state.begin(protoLabel(isTLS), conn.RemoteAddr().String(), opt, 1, func() { conn.Close() })
+	if errAdmit != nil {
+		log.Printf("handleConnection: refusing %v: %v", conn.RemoteAddr(), errAdmit)
+		a.Reject = errAdmit.Error()
+		ackSend(w, conn, a)
+		return
+	}
+	defer state.end(s)
+
+	if opt.Control {
+		handleControl(app, w, conn, s.info.Options, state)
+		return
+	}
+
+	if t != nil {
+		state.attach(t, s)
+	}
+
+	if s.info.Options.MaxSpeed != opt.MaxSpeed {
+		log.Printf("handleConnection: maxSpeed capped to %v: %v", s.info.Options.MaxSpeed, conn.RemoteAddr())
+	}
+	opt = s.info.Options
+
+	// send ack
+	if errAck := ackSend(w, conn, a); errAck != nil {
 		log.Printf("handleConnection: sending ack: %v", errAck)
 		return
 	}
 
-	go serverReader(conn, opt, c, connections, isTLS, aggReader)
+	conn.SetDeadline(time.Time{})
+
+	if opt.SyncStart {
+		if t != nil {
+			select {
+			case <-t.start:
+			case <-s.stop:
+				log.Printf("handleConnection: waiting start: %s: %v", s.reason, conn.RemoteAddr())
+				return
+			}
+		} else if errStart := startRecv(conn); errStart != nil {
+			log.Printf("handleConnection: waiting start: %v", errStart)
+			return
+		}
+		log.Printf("handleConnection: start received: %v", conn.RemoteAddr())
+	}
+
+	start := time.Now()
+
+	doneReader := make(chan struct{})
+	doneWriter := make(chan struct{})
+	stopWriter := make(chan struct{})
+
+	var verify *verifier
+	if opt.Verify {
+		verify = &s.verify
+	}
+
+	go serverReader(conn, opt, app.Unit, c, connections, isTLS, s.maxSpeed, doneReader, &s.aggReader, verify)
 
-	if !opt.PassiveServer {
-		go serverWriter(conn, opt, c, connections, isTLS, aggWriter)
+	if opt.PassiveServer {
+		close(doneWriter)
+	} else {
+		go serverWriter(conn, opt, app.Unit, c, connections, isTLS, stopWriter, doneWriter, &s.aggWriter)
 	}
 
-	tickerPeriod := time.NewTimer(opt.TotalDuration)
+	timeout, stopTimeout := opt.deadline(start)
+
+	if opt.hasLimit() {
+		if waitTransfer(doneReader, doneWriter, timeout, nil) {
+			log.Printf("handleConnection: transfer completed in %v: %v", time.Since(start), conn.RemoteAddr())
+		} else {
+			log.Printf("handleConnection: transfer incomplete: %v timer: %v", opt.testDuration(), conn.RemoteAddr())
+		}
+	} else {
+		select {
+		case <-timeout:
+			log.Printf("handleConnection: %v timer", opt.testDuration())
+		case <-s.stop:
+			log.Printf("handleConnection: %s: %v", s.reason, conn.RemoteAddr())
+		case <-doneReader:
+			log.Printf("handleConnection: client ended the test: %v", conn.RemoteAddr())
+		}
+	}
 
-	<-tickerPeriod.C
-	log.Printf("handleConnection: %v timer", opt.TotalDuration)
+	stopTimeout()
 
-	tickerPeriod.Stop()
+	if s.stopped() {
+		conn.Close() // forced end, do not wait for the client
+	} else {
+		endTransfer(conn, stopWriter, doneReader, doneWriter, drainTimeout)
+	}
 
 	log.Printf("handleConnection: closing: %v", conn.RemoteAddr())
+
+	conn.Close()
+
+	<-doneReader // wait reader exit
+	<-doneWriter // wait writer exit
+}
+
+// authServer challenges a TCP client with a nonce and checks its answer.
+func authServer(secret string, w wire, conn net.Conn, opt Options) error {
+	if !opt.Auth {
+		return errAuthRequired
+	}
+
+	nonce, errNonce := newNonce()
+	if errNonce != nil {
+		return fmt.Errorf("nonce: %v", errNonce)
+	}
+
+	a := newAck()
+	a.Nonce = nonce
+	if errAck := ackSend(w, conn, a); errAck != nil {
+		return fmt.Errorf("sending challenge: %v", errAck)
+	}
+
+	var m authMsg
+	if errRecv := w.recv(conn, &m); errRecv != nil {
+		return fmt.Errorf("receiving authentication: %v", errRecv)
+	}
+
+	if !authValid(secret, nonce, m) {
+		return errAuthFailed
+	}
+
+	return nil
 }
 
-func serverReader(conn net.Conn, opt Options, c, connections int, isTLS bool, agg *aggregate) {
+var errAuthRequired = fmt.Errorf("authentication required: use -secret")
+var errAuthFailed = fmt.Errorf("authentication failed: wrong secret")
+var errUnknownCookie = fmt.Errorf("unknown test cookie")
+
+// serverReader checks data with verify, which is nil without Options.Verify.
+func serverReader(conn net.Conn, opt Options, unit Unit, c, connections int, isTLS bool, maxSpeed float64, done chan struct{}, agg *aggregate, verify *verifier) {
 
 	log.Printf("serverReader: starting: %s %v", protoLabel(isTLS), conn.RemoteAddr())
 
@@ -266,7 +630,19 @@ func serverReader(conn net.Conn, opt Options, c, connections int, isTLS bool, ag
 
 	buf := make([]byte, opt.TCPReadSize)
 
-	workLoop(connIndex, "serverReader", "rcv/s", conn.Read, buf, opt.ReportInterval, 0, nil, agg)
+	read := conn.Read
+	if verify != nil {
+		read = verifyReader(read, verify, false)
+	}
+
+	workLoop(connIndex, "serverReader", "rcv/s", read, buf, opt, false, maxSpeed, unit, nil, agg, nil)
+
+	if verify != nil {
+		blocks, corrupted := verify.result()
+		log.Printf("serverReader: %s verify: %d/%d block(s) corrupted: %v", connIndex, corrupted, blocks, conn.RemoteAddr())
+	}
+
+	close(done)
 
 	log.Printf("serverReader: exiting: %v", conn.RemoteAddr())
 }
@@ -278,37 +654,56 @@ func protoLabel(isTLS bool) string {
 	return "TCP"
 }
 
-func serverWriter(conn net.Conn, opt Options, c, connections int, isTLS bool, agg *aggregate) {
+func serverWriter(conn net.Conn, opt Options, unit Unit, c, connections int, isTLS bool, stop, done chan struct{}, agg *aggregate) {
 
 	log.Printf("serverWriter: starting: %s %v", protoLabel(isTLS), conn.RemoteAddr())
 
 	connIndex := fmt.Sprintf("%d/%d", c, connections)
 
-	buf := randBuf(opt.TCPWriteSize)
+	buf := payloadBuf(opt, opt.TCPWriteSize)
 
-	workLoop(connIndex, "serverWriter", "snd/s", conn.Write, buf, opt.ReportInterval, opt.MaxSpeed, nil, agg)
+	write := conn.Write
+	if zeroCopy, release := zeroCopyWriter("serverWriter", conn, buf, opt); zeroCopy != nil {
+		write = zeroCopy
+		defer release()
+	}
+	if opt.Verify {
+		write = patternWrite(write, false)
+	}
+
+	workLoop(connIndex, "serverWriter", "snd/s", write, buf, opt, false, opt.MaxSpeed, unit, nil, agg, stop)
+
+	close(done)
 
 	log.Printf("serverWriter: exiting: %v", conn.RemoteAddr())
 }
 
-func serverWriterTo(conn *net.UDPConn, opt Options, dst net.Addr, acc *account, c, connections int, agg *aggregate) {
+func serverWriterTo(conn *net.UDPConn, opt Options, unit Unit, dst net.Addr, start time.Time, c, connections int, s *session, state *serverState) {
 	log.Printf("serverWriterTo: starting: UDP %v", dst)
 
-	start := acc.prevTime
-
 	udpWriteTo := func(b []byte) (int, error) {
-		if time.Since(start) > opt.TotalDuration {
-			return -1, fmt.Errorf("udpWriteTo: total duration %s timer", opt.TotalDuration)
+		if opt.hasDeadline() && time.Since(start) > opt.testDuration() {
+			return -1, fmt.Errorf("udpWriteTo: total duration %s timer: %w", opt.testDuration(), errTestEnd)
+		}
+
+		if s.stopped() {
+			return -1, fmt.Errorf("udpWriteTo: %s: %w", s.reason, errTestEnd)
 		}
 
 		return conn.WriteTo(b, dst)
 	}
+	if opt.Verify {
+		udpWriteTo = patternWrite(udpWriteTo, true)
+	}
+	udpWriteTo = seqWriter(udpWriteTo)
 
 	connIndex := fmt.Sprintf("%d/%d", c, connections)
 
-	buf := randBuf(opt.UDPWriteSize)
+	buf := payloadBuf(opt, opt.UDPWriteSize)
+
+	workLoop(connIndex, "serverWriterTo", "snd/s", udpWriteTo, buf, opt, true, opt.MaxSpeed, unit, nil, &s.aggWriter, nil)
 
-	workLoop(connIndex, "serverWriterTo", "snd/s", udpWriteTo, buf, opt.ReportInterval, opt.MaxSpeed, nil, agg)
+	state.end(s)
 
 	log.Printf("serverWriterTo: exiting: %v", dst)
 }
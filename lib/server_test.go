@@ -0,0 +1,72 @@
+package lib
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestAppendPort(t *testing.T) {
+	expectAppendPort(t, "", "", "")
+	expectAppendPort(t, "", ":80", ":80")
+	//expectAppendPort(t, ":", ":80", ":80")
+
+	expectAppendPort(t, "localhost", ":80", "localhost:80")
+	expectAppendPort(t, "localhost:8080", ":80", "localhost:8080")
+	//expectAppendPort(t, "localhost:", ":80", "localhost:80")
+
+	expectAppendPort(t, "127.0.0.1", ":80", "127.0.0.1:80")
+	expectAppendPort(t, "127.0.0.1:8080", ":80", "127.0.0.1:8080")
+	//expectAppendPort(t, "127.0.0.1:", ":80", "127.0.0.1:80")
+
+	expectAppendPort(t, "[::1]", ":80", "[::1]:80")
+	expectAppendPort(t, "[::1]:8080", ":80", "[::1]:8080")
+	//expectAppendPort(t, "[::1]:", ":80", "[::1]:80")
+}
+
+func expectAppendPort(t *testing.T, host, port, wanted string) {
+	result := appendPortIfMissing(host, port)
+	if result != wanted {
+		t.Errorf("expectAppendPort: host=%s port=%s result=%s wanted=%s",
+			host, port, result, wanted)
+	}
+}
+
+// testServer starts a plain TCP/UDP server on a free loopback port, for the
+// lifetime of the test binary, and returns its address.
+func testServer(t *testing.T) string {
+	listener, errListen := net.Listen("tcp", "127.0.0.1:0")
+	if errListen != nil {
+		t.Fatal(errListen)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+
+	app := &Config{Listeners: []string{addr}}
+	app.Opt.UDPReadSize = 64000
+	go serve(app)
+
+	for begin := time.Now(); ; time.Sleep(10 * time.Millisecond) {
+		conn, errDial := net.Dial("tcp", addr)
+		if errDial == nil {
+			conn.Close()
+			return addr
+		}
+		if time.Since(begin) > 5*time.Second {
+			t.Fatalf("testServer: %s: %v", addr, errDial)
+		}
+	}
+}
+
+// testClientConfig is a short client test against addr.
+func testClientConfig(addr string) Config {
+	app := Config{Hosts: []string{addr}, Connections: 1}
+	app.Opt.ReportInterval = 100 * time.Millisecond
+	app.Opt.TotalDuration = 300 * time.Millisecond
+	app.Opt.TCPReadSize = 100000
+	app.Opt.TCPWriteSize = 100000
+	app.Opt.UDPReadSize = 64000
+	app.Opt.UDPWriteSize = 64000
+	app.Opt.MaxSpeed = 100
+	return app
+}
@@ -0,0 +1,310 @@
+package lib
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// maxResults is the number of finished sessions kept for the control API.
+const maxResults = 100
+
+// Limits are server-side limits, zero values mean unlimited.
+type Limits struct {
+	MaxSessions   int           // concurrent test sessions
+	MaxBufferSize int           // largest read or write size a client may request, in bytes
+	MaxDuration   time.Duration // longest test a client may request, including omit
+	MaxSpeed      float64       // per session rate in each direction, mbps
+}
+
+func (l Limits) validate() error {
+	if l.MaxSessions < 0 || l.MaxBufferSize < 0 || l.MaxDuration < 0 || l.MaxSpeed < 0 {
+		return fmt.Errorf("negative limit: %+v", l)
+	}
+	return nil
+}
+
+// admit checks the options requested by a client against l.
+// It returns the options to apply, with MaxSpeed capped to l.MaxSpeed,
+// or an error giving the reason for refusing the session. Control
+// connections transfer no test data, so buffer sizes do not apply.
+func (l Limits) admit(opt Options, udp bool) (Options, error) {
+	if l.MaxBufferSize > 0 && !opt.Control {
+		names := []string{"udpWriteSize"}
+		sizes := []int{opt.UDPWriteSize}
+		if !udp {
+			names = []string{"tcpReadSize", "tcpWriteSize"}
+			sizes = []int{opt.TCPReadSize, opt.TCPWriteSize}
+		}
+		for i, size := range sizes {
+			if size > l.MaxBufferSize {
+				return opt, fmt.Errorf("%s=%d exceeds server limit %d", names[i], size, l.MaxBufferSize)
+			}
+		}
+	}
+
+	if l.MaxDuration > 0 {
+		if !opt.hasDeadline() {
+			return opt, fmt.Errorf("transfer without totalDuration exceeds server limit %v", l.MaxDuration)
+		}
+		if opt.testDuration() > l.MaxDuration {
+			return opt, fmt.Errorf("duration %v exceeds server limit %v", opt.testDuration(), l.MaxDuration)
+		}
+	}
+
+	if l.MaxSpeed > 0 && (opt.MaxSpeed == 0 || opt.MaxSpeed > l.MaxSpeed) {
+		opt.MaxSpeed = l.MaxSpeed
+	}
+
+	return opt, nil
+}
+
+// SessionInfo describes an active test session on the server.
+type SessionInfo struct {
+	ID          int
+	Proto       string // TCP, TLS or UDP
+	Remote      string
+	Start       time.Time
+	Options     Options
+	InputBytes  int64 // received so far
+	OutputBytes int64 // sent so far
+
+	PayloadSize int `json:",omitempty"` // length of Options.PayloadData, which is left out
+}
+
+// SessionResult describes a finished test session.
+type SessionResult struct {
+	Session     SessionInfo
+	End         time.Time
+	Kicked      bool
+	InputStats  Stats
+	OutputStats Stats
+
+	CorruptedBlocks int64 `json:",omitempty"` // received, with Options.Verify
+}
+
+// session is a test session: one TCP/TLS connection or one UDP remote address.
+type session struct {
+	info      SessionInfo
+	aggReader aggregate
+	aggWriter aggregate
+	verify    verifier      // checks received data with Options.Verify
+	maxSpeed  float64       // reading limit, mbps
+	pending   int           // halves (reader, writer) still running
+	stop      chan struct{} // closed when kicked or stopped
+	closed    bool          // stop is closed
+	reason    string        // why the session was stopped
+	kicked    bool
+	kick      func()   // forces the session to end
+	test      *testCtl // control connection of the test, nil for legacy clients
+}
+
+// stopped reports whether the session was kicked or stopped.
+func (s *session) stopped() bool {
+	select {
+	case <-s.stop:
+		return true
+	default:
+	}
+	return false
+}
+
+// serverState tracks sessions across all server listeners.
+type serverState struct {
+	mutex    sync.Mutex
+	nextID   int
+	sessions map[int]*session
+	results  []SessionResult // most recent last
+	limits   Limits
+	tests    map[string]*testCtl // tests with a control connection, by cookie
+	refused  int                 // sessions refused by limits
+	rejected int                 // failed authentication attempts
+}
+
+// ServerStatus summarizes the server state for the control API.
+type ServerStatus struct {
+	Sessions     int // active
+	Refused      int // refused by limits since start
+	AuthRejected int // failed authentication attempts since start
+}
+
+func newServerState(limits Limits) *serverState {
+	return &serverState{
+		sessions: map[int]*session{},
+		tests:    map[string]*testCtl{},
+		limits:   limits,
+	}
+}
+
+// begin registers a session with halves running directions.
+// The error is the reason for refusing the session, see Limits.
+func (st *serverState) begin(proto, remote string, opt Options, halves int, kick func()) (*session, error) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	if st.limits.MaxSessions > 0 && len(st.sessions) >= st.limits.MaxSessions {
+		st.refused++
+		return nil, fmt.Errorf("server busy: %d/%d sessions", len(st.sessions), st.limits.MaxSessions)
+	}
+
+	opt, errAdmit := st.limits.admit(opt, proto == "UDP")
+	if errAdmit != nil {
+		st.refused++
+		return nil, errAdmit
+	}
+
+	s := &session{
+		info: SessionInfo{
+			ID:      st.nextID,
+			Proto:   proto,
+			Remote:  remote,
+			Start:   time.Now(),
+			Options: opt,
+		},
+		maxSpeed: st.limits.MaxSpeed,
+		pending:  halves,
+		stop:     make(chan struct{}),
+		kick:     kick,
+	}
+	st.nextID++
+	st.sessions[s.info.ID] = s
+
+	return s, nil
+}
+
+// end marks one half of the session as finished. When both halves are done,
+// the session moves to the recent results.
+func (st *serverState) end(s *session) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	s.pending--
+	if s.pending > 0 {
+		return
+	}
+
+	delete(st.sessions, s.info.ID)
+
+	r := SessionResult{
+		Session:     s.snapshot(),
+		End:         time.Now(),
+		Kicked:      s.kicked,
+		InputStats:  s.aggReader.stats(),
+		OutputStats: s.aggWriter.stats(),
+	}
+	if s.info.Options.Verify {
+		_, r.CorruptedBlocks = s.verify.result()
+	}
+	st.results = append(st.results, r)
+	if len(st.results) > maxResults {
+		st.results = st.results[len(st.results)-maxResults:]
+	}
+
+	if s.test != nil {
+		s.test.results = append(s.test.results, r)
+		s.test.running--
+	}
+}
+
+// snapshot copies session info with current byte counters. The payload
+// file is reported by its size only, to keep listings and results short.
+func (s *session) snapshot() SessionInfo {
+	info := s.info
+	info.PayloadSize = len(info.Options.PayloadData)
+	info.Options.PayloadData = nil
+	info.InputBytes = atomic.LoadInt64(&s.aggReader.live)
+	info.OutputBytes = atomic.LoadInt64(&s.aggWriter.live)
+	return info
+}
+
+func (st *serverState) list() []SessionInfo {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+
+	list := []SessionInfo{}
+	for _, s := range st.sessions {
+		list = append(list, s.snapshot())
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+func (st *serverState) recent() []SessionResult {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	return append([]SessionResult{}, st.results...)
+}
+
+// kickSession forces session id to end. It returns false if id is not active.
+func (st *serverState) kickSession(id int) bool {
+	st.mutex.Lock()
+	s, found := st.sessions[id]
+	if found && !s.closed {
+		s.kicked = true
+	}
+	st.mutex.Unlock()
+
+	if !found {
+		return false
+	}
+
+	st.stopSession(s, "kicked")
+	if s.test != nil {
+		s.test.notifyKick(id)
+	}
+	return true
+}
+
+// stopSession forces s to end, unless it is already stopping.
+func (st *serverState) stopSession(s *session, reason string) {
+	st.mutex.Lock()
+	if s.closed {
+		st.mutex.Unlock()
+		return
+	}
+	s.closed = true
+	s.reason = reason
+	close(s.stop)
+	st.mutex.Unlock()
+
+	log.Printf("serverState: %s %s session %d: %s", reason, s.info.Proto, s.info.ID, s.info.Remote)
+	if s.kick != nil {
+		s.kick()
+	}
+}
+
+// rejectAuth counts and logs a failed authentication attempt.
+func (st *serverState) rejectAuth(proto, remote string, reason error) {
+	st.mutex.Lock()
+	st.rejected++
+	n := st.rejected
+	st.mutex.Unlock()
+
+	log.Printf("serverState: %s authentication rejected: %s: %v (%d rejected)", proto, remote, reason, n)
+}
+
+func (st *serverState) status() ServerStatus {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	return ServerStatus{
+		Sessions:     len(st.sessions),
+		Refused:      st.refused,
+		AuthRejected: st.rejected,
+	}
+}
+
+func (st *serverState) getLimits() Limits {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	return st.limits
+}
+
+func (st *serverState) setLimits(l Limits) {
+	st.mutex.Lock()
+	defer st.mutex.Unlock()
+	log.Printf("serverState: limits changed: %+v => %+v", st.limits, l)
+	st.limits = l
+}
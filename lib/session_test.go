@@ -0,0 +1,60 @@
+package lib
+
+import (
+	"testing"
+	"time"
+)
+
+func TestServerState(t *testing.T) {
+	state := newServerState(Limits{MaxSessions: 1})
+
+	kicked := false
+	s, errBegin := state.begin("TCP", "client:1", Options{}, 2, func() { kicked = true })
+	if errBegin != nil {
+		t.Fatalf("begin: session refused under limit: %v", errBegin)
+	}
+	if _, errBegin := state.begin("UDP", "client:2", Options{}, 1, nil); errBegin == nil {
+		t.Errorf("begin: session accepted over limit")
+	}
+
+	if !state.kickSession(s.info.ID) || !kicked || !s.stopped() {
+		t.Errorf("kickSession: session not kicked")
+	}
+	if state.kickSession(99) {
+		t.Errorf("kickSession: unknown session kicked")
+	}
+
+	state.end(s)
+	if len(state.list()) != 1 || len(state.recent()) != 0 {
+		t.Errorf("end: session finished with a half still running")
+	}
+	state.end(s)
+	if len(state.list()) != 0 {
+		t.Errorf("end: session still active")
+	}
+	if r := state.recent(); len(r) != 1 || !r[0].Kicked || r[0].Session.Remote != "client:1" {
+		t.Errorf("end: results=%+v", r)
+	}
+}
+
+func TestLimitsAdmit(t *testing.T) {
+	l := Limits{MaxBufferSize: 1000, MaxDuration: 10 * time.Second, MaxSpeed: 100}
+
+	opt, err := l.admit(Options{TotalDuration: 5 * time.Second, TCPReadSize: 1000, TCPWriteSize: 1000, UDPWriteSize: 64000}, false)
+	if err != nil {
+		t.Errorf("admit: %v", err)
+	}
+	if opt.MaxSpeed != 100 {
+		t.Errorf("admit: maxSpeed=%v wanted=100", opt.MaxSpeed)
+	}
+
+	for _, bad := range []Options{
+		{TotalDuration: 5 * time.Second, TCPReadSize: 1001},
+		{TotalDuration: 8 * time.Second, Omit: 3 * time.Second},
+		{TotalBytes: 1000},
+	} {
+		if _, err := l.admit(bad, false); err == nil {
+			t.Errorf("admit: options=%+v: expected error", bad)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package lib
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// Stats summarizes the periodic rate samples of one direction.
+// All rates are expressed in the report unit.
+type Stats struct {
+	Samples int     // number of interval samples
+	Average float64 // total bytes over total elapsed time
+	Min     float64
+	Max     float64
+	Mean    float64 // mean of interval samples
+	StdDev  float64
+	P5      float64
+	P50     float64
+	P95     float64
+	CV      float64       // coefficient of variation: StdDev/Mean
+	Omitted float64       // average during the omit period, excluded from the fields above
+	Bytes   int64         // bytes transferred, including the omit period
+	Elapsed time.Duration // transfer time, including the omit period
+}
+
+func computeStats(average float64, samples []float64) Stats {
+	s := Stats{Samples: len(samples), Average: average}
+	if len(samples) == 0 {
+		return s
+	}
+
+	sorted := append([]float64(nil), samples...)
+	sort.Float64s(sorted)
+
+	var sum float64
+	for _, v := range sorted {
+		sum += v
+	}
+	s.Mean = sum / float64(len(sorted))
+
+	var sq float64
+	for _, v := range sorted {
+		d := v - s.Mean
+		sq += d * d
+	}
+	s.StdDev = math.Sqrt(sq / float64(len(sorted)))
+
+	s.Min = sorted[0]
+	s.Max = sorted[len(sorted)-1]
+	s.P5 = percentile(sorted, 5)
+	s.P50 = percentile(sorted, 50)
+	s.P95 = percentile(sorted, 95)
+
+	if s.Mean != 0 {
+		s.CV = s.StdDev / s.Mean
+	}
+
+	return s
+}
+
+// percentile interpolates linearly between the closest ranks of sorted.
+func percentile(sorted []float64, p float64) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := p / 100 * float64(len(sorted)-1)
+	lower := int(math.Floor(rank))
+	upper := int(math.Ceil(rank))
+	frac := rank - float64(lower)
+	return sorted[lower] + frac*(sorted[upper]-sorted[lower])
+}
+
+func (s Stats) String() string {
+	return fmt.Sprintf("min=%.3f max=%.3f mean=%.3f stddev=%.3f p5=%.3f p50=%.3f p95=%.3f cv=%.3f samples=%d",
+		s.Min, s.Max, s.Mean, s.StdDev, s.P5, s.P50, s.P95, s.CV, s.Samples)
+}
+
+// statsFields lists stats as name/value pairs for flat exports.
+func (s Stats) statsFields() [][2]string {
+	f := func(v float64) string { return fmt.Sprintf("%v", v) }
+	return [][2]string{
+		{"samples", fmt.Sprintf("%d", s.Samples)},
+		{"average", f(s.Average)},
+		{"min", f(s.Min)},
+		{"max", f(s.Max)},
+		{"mean", f(s.Mean)},
+		{"stddev", f(s.StdDev)},
+		{"p5", f(s.P5)},
+		{"p50", f(s.P50)},
+		{"p95", f(s.P95)},
+		{"cv", f(s.CV)},
+		{"omitted", f(s.Omitted)},
+		{"bytes", fmt.Sprintf("%d", s.Bytes)},
+		{"elapsed", s.Elapsed.String()},
+	}
+}
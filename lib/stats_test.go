@@ -0,0 +1,34 @@
+package lib
+
+import (
+	"math"
+	"testing"
+)
+
+func TestComputeStats(t *testing.T) {
+	s := computeStats(3, []float64{4, 1, 3, 2, 5})
+
+	expectFloat(t, "min", s.Min, 1)
+	expectFloat(t, "max", s.Max, 5)
+	expectFloat(t, "mean", s.Mean, 3)
+	expectFloat(t, "stddev", s.StdDev, math.Sqrt(2))
+	expectFloat(t, "p5", s.P5, 1.2)
+	expectFloat(t, "p50", s.P50, 3)
+	expectFloat(t, "p95", s.P95, 4.8)
+	expectFloat(t, "cv", s.CV, math.Sqrt(2)/3)
+
+	if s.Samples != 5 {
+		t.Errorf("samples: result=%d wanted=5", s.Samples)
+	}
+
+	empty := computeStats(0, nil)
+	if empty.Samples != 0 || empty.Max != 0 {
+		t.Errorf("empty stats: %v", empty)
+	}
+}
+
+func expectFloat(t *testing.T, name string, result, wanted float64) {
+	if math.Abs(result-wanted) > 1e-9 {
+		t.Errorf("%s: result=%v wanted=%v", name, result, wanted)
+	}
+}
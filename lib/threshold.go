@@ -0,0 +1,137 @@
+package lib
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Thresholds are pass/fail assertions evaluated at the end of a client run.
+// Zero values disable the corresponding check, except MaxLoss with CheckLoss.
+type Thresholds struct {
+	MinRate    float64       // minimum aggregate rate per active direction, in report unit
+	MaxLoss    float64       // maximum UDP datagram loss, percent
+	MaxRTT     time.Duration // maximum handshake round-trip time
+	RequireAll bool          // every connection must succeed
+	CheckLoss  bool          // check MaxLoss even when zero, to fail on any loss
+}
+
+// Result summarizes a client run.
+type Result struct {
+	Unit      string
+	Attempted int           // connections attempted
+	Connected int           // connections which completed the handshake
+	Input     Stats         // aggregate reading
+	Output    Stats         // aggregate writing
+	MaxRTT    time.Duration // highest handshake round-trip time, zero if not measured
+
+	MaxStartOffset  time.Duration // latest connection start after the synchronized start
+	Expected        int64         // UDP datagrams expected from the server
+	Lost            int64         // UDP datagrams lost
+	TransferErrors  int64         `json:",omitempty" yaml:",omitempty"` // reads or writes ended by an error instead of the end of test
+	ByteMismatches  int           `json:",omitempty" yaml:",omitempty"` // host directions where bytes received differ from bytes sent, see HostResult
+	CorruptedBlocks int64         `json:",omitempty" yaml:",omitempty"` // blocks not matching the pattern with Options.Verify, on both sides
+	CPUUser         time.Duration `json:",omitempty" yaml:",omitempty"` // process user CPU time during the run, where available
+	CPUSystem       time.Duration `json:",omitempty" yaml:",omitempty"` // process system CPU time during the run
+	Hosts           []HostResult  // per-host connection summary
+	Steps           []RampStep    `json:",omitempty" yaml:",omitempty"` // per-step aggregates with -rampUp/-rampDown
+}
+
+// HostResult summarizes connections to one -hosts entry.
+type HostResult struct {
+	Host      string
+	Attempted int
+	Connected int
+	Errors    map[string]int `json:",omitempty" yaml:",omitempty"` // count by distinct dial or handshake error
+
+	InputBytes      int64 // received by the client
+	OutputBytes     int64 // sent by the client
+	CorruptedBlocks int64 `json:",omitempty" yaml:",omitempty"` // received by the client, with Options.Verify
+
+	// reported by the server through the control connection
+	ServerSessions    int   `json:",omitempty" yaml:",omitempty"`
+	ServerInputBytes  int64 `json:",omitempty" yaml:",omitempty"` // received by the server
+	ServerOutputBytes int64 `json:",omitempty" yaml:",omitempty"` // sent by the server
+
+	ServerCorruptedBlocks int64 `json:",omitempty" yaml:",omitempty"` // received by the server, with Options.Verify
+}
+
+// Loss is the percent of UDP datagrams lost.
+func (r Result) Loss() float64 {
+	return lossPercent(r.Expected, r.Lost)
+}
+
+// ErrNoConnection is returned by BuildClient when no connection succeeded.
+var ErrNoConnection = errors.New("no connection succeeded")
+
+// ThresholdError lists the failed assertions of a client run.
+type ThresholdError struct {
+	Failures []string
+}
+
+func (e *ThresholdError) Error() string {
+	return "threshold failed: " + strings.Join(e.Failures, "; ")
+}
+
+// evaluate checks result against app.Thresholds and logs a summary.
+func evaluate(app *Config, result Result) error {
+	if result.Connected == 0 {
+		log.Printf("evaluate: FAIL: %d/%d connections", result.Connected, result.Attempted)
+		return ErrNoConnection
+	}
+
+	th := app.Thresholds
+
+	var failures []string
+
+	check := func(pass bool, format string, a ...interface{}) {
+		m := fmt.Sprintf(format, a...)
+		if pass {
+			log.Printf("evaluate: PASS: %s", m)
+			return
+		}
+		log.Printf("evaluate: FAIL: %s", m)
+		failures = append(failures, m)
+	}
+
+	if th.RequireAll {
+		check(result.Connected == result.Attempted, "%d/%d connections succeeded", result.Connected, result.Attempted)
+	}
+
+	if th.MinRate > 0 {
+		if !app.Opt.PassiveServer {
+			check(result.Input.Average >= th.MinRate, "aggregate input %.3f %s (minimum %.3f)", result.Input.Average, result.Unit, th.MinRate)
+		}
+		if !app.PassiveClient {
+			check(result.Output.Average >= th.MinRate, "aggregate output %.3f %s (minimum %.3f)", result.Output.Average, result.Unit, th.MinRate)
+		}
+	}
+
+	if th.MaxLoss > 0 || th.CheckLoss {
+		if result.Expected > 0 {
+			check(result.Loss() <= th.MaxLoss, "loss %.3f%% %d/%d datagrams (maximum %.3f%%)", result.Loss(), result.Lost, result.Expected, th.MaxLoss)
+		} else {
+			log.Printf("evaluate: SKIP: loss not measured (UDP only)")
+		}
+	}
+
+	if app.Opt.Verify {
+		check(result.CorruptedBlocks == 0, "%d corrupted block(s) with -verify", result.CorruptedBlocks)
+	}
+
+	if th.MaxRTT > 0 {
+		if result.MaxRTT > 0 {
+			check(result.MaxRTT <= th.MaxRTT, "handshake rtt %v (maximum %v)", result.MaxRTT, th.MaxRTT)
+		} else {
+			log.Printf("evaluate: SKIP: rtt not measured (TCP only)")
+		}
+	}
+
+	if len(failures) > 0 {
+		return &ThresholdError{Failures: failures}
+	}
+
+	return nil
+}
@@ -0,0 +1,85 @@
+package lib
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEvaluate(t *testing.T) {
+	good := Result{
+		Unit:      "Mbps",
+		Attempted: 4,
+		Connected: 4,
+		Input:     Stats{Average: 100},
+		Output:    Stats{Average: 200},
+		MaxRTT:    time.Millisecond,
+		Expected:  1000,
+		Lost:      10,
+	}
+
+	table := []struct {
+		name   string
+		th     Thresholds
+		change func(app *Config, r *Result)
+		failed string // substring of the single failure, empty for pass
+	}{
+		{"no thresholds", Thresholds{}, nil, ""},
+		{"requireAll pass", Thresholds{RequireAll: true}, nil, ""},
+		{"requireAll fail", Thresholds{RequireAll: true}, func(app *Config, r *Result) { r.Connected = 3 }, "3/4 connections"},
+		{"minRate equal", Thresholds{MinRate: 100}, nil, ""},
+		{"minRate input", Thresholds{MinRate: 150}, nil, "aggregate input"},
+		{"minRate output", Thresholds{MinRate: 250}, func(app *Config, r *Result) { r.Input.Average = 300 }, "aggregate output"},
+		{"minRate passive server", Thresholds{MinRate: 150}, func(app *Config, r *Result) { app.Opt.PassiveServer = true }, ""},
+		{"minRate passive client", Thresholds{MinRate: 50}, func(app *Config, r *Result) { app.PassiveClient = true; r.Output.Average = 0 }, ""},
+		{"maxLoss equal", Thresholds{MaxLoss: 1}, nil, ""},
+		{"maxLoss fail", Thresholds{MaxLoss: 0.5}, nil, "loss 1.000%"},
+		{"maxLoss zero unchecked", Thresholds{}, nil, ""},
+		{"maxLoss zero checked", Thresholds{CheckLoss: true}, nil, "loss 1.000%"},
+		{"maxLoss zero no loss", Thresholds{CheckLoss: true}, func(app *Config, r *Result) { r.Lost = 0 }, ""},
+		{"maxLoss not measured", Thresholds{MaxLoss: 0.5, CheckLoss: true}, func(app *Config, r *Result) { r.Expected, r.Lost = 0, 0 }, ""},
+		{"maxRTT equal", Thresholds{MaxRTT: time.Millisecond}, nil, ""},
+		{"maxRTT fail", Thresholds{MaxRTT: time.Microsecond}, nil, "handshake rtt"},
+		{"maxRTT not measured", Thresholds{MaxRTT: time.Microsecond}, func(app *Config, r *Result) { r.MaxRTT = 0 }, ""},
+		{"verify pass", Thresholds{}, func(app *Config, r *Result) { app.Opt.Verify = true }, ""},
+		{"verify fail", Thresholds{}, func(app *Config, r *Result) { app.Opt.Verify = true; r.CorruptedBlocks = 2 }, "2 corrupted block(s)"},
+	}
+
+	for _, d := range table {
+		app := &Config{Thresholds: d.th}
+		r := good
+		if d.change != nil {
+			d.change(app, &r)
+		}
+		err := evaluate(app, r)
+		if d.failed == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", d.name, err)
+			}
+			continue
+		}
+		te, isThreshold := err.(*ThresholdError)
+		if !isThreshold || len(te.Failures) != 1 || !strings.Contains(te.Failures[0], d.failed) {
+			t.Errorf("%s: error=%v wanted failure %q", d.name, err, d.failed)
+		}
+	}
+}
+
+func TestEvaluateNoConnection(t *testing.T) {
+	app := &Config{Thresholds: Thresholds{MinRate: 1, RequireAll: true}}
+	if err := evaluate(app, Result{Attempted: 2}); err != ErrNoConnection {
+		t.Errorf("no connection: error=%v wanted=%v", err, ErrNoConnection)
+	}
+}
+
+func TestEvaluateFailures(t *testing.T) {
+	app := &Config{Thresholds: Thresholds{MinRate: 1000, MaxLoss: 0.1, MaxRTT: time.Microsecond}}
+	err := evaluate(app, Result{Attempted: 1, Connected: 1, Expected: 100, Lost: 1, MaxRTT: time.Second})
+	te, isThreshold := err.(*ThresholdError)
+	if !isThreshold || len(te.Failures) != 4 {
+		t.Fatalf("all failed: error=%v wanted 4 failures", err)
+	}
+	if !strings.HasPrefix(te.Error(), "threshold failed: aggregate input") {
+		t.Errorf("error message: %q", te.Error())
+	}
+}
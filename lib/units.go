@@ -0,0 +1,69 @@
+package lib
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Unit is a display unit for transfer rates.
+type Unit struct {
+	Name string  // label shown in reports, e.g. "Mbps"
+	Bits float64 // bits per second represented by one unit
+}
+
+// DefaultUnit is used when no unit has been configured.
+var DefaultUnit = Unit{Name: "Mbps", Bits: 1e6}
+
+var unitPrefixes = map[string]float64{
+	"":   1,
+	"k":  1e3,
+	"m":  1e6,
+	"g":  1e9,
+	"t":  1e12,
+	"ki": 1 << 10,
+	"mi": 1 << 20,
+	"gi": 1 << 30,
+	"ti": 1 << 40,
+}
+
+// ParseUnit parses a rate unit name.
+// The suffix selects bits ("bps") or bytes ("Bps"), the optional prefix
+// selects SI (k, M, G, T) or IEC (Ki, Mi, Gi, Ti) multipliers.
+// Examples: bps, Kbps, Mbps, Gbps, MBps, Mibps, GiBps.
+func ParseUnit(name string) (Unit, error) {
+	var bits float64
+	var prefix string
+	switch {
+	case strings.HasSuffix(name, "bps"):
+		bits = 1
+		prefix = strings.TrimSuffix(name, "bps")
+	case strings.HasSuffix(name, "Bps"):
+		bits = 8
+		prefix = strings.TrimSuffix(name, "Bps")
+	default:
+		return Unit{}, fmt.Errorf("ParseUnit: bad unit: %q: must end with 'bps' (bits) or 'Bps' (bytes)", name)
+	}
+
+	mult, found := unitPrefixes[strings.ToLower(prefix)]
+	if !found {
+		return Unit{}, fmt.Errorf("ParseUnit: bad unit prefix: %q: %q", name, prefix)
+	}
+
+	return Unit{Name: name, Bits: bits * mult}, nil
+}
+
+func (u Unit) orDefault() Unit {
+	if u.Bits <= 0 {
+		return DefaultUnit
+	}
+	return u
+}
+
+// scale converts bits per second into this unit.
+func (u Unit) scale(bps float64) float64 {
+	return bps / u.orDefault().Bits
+}
+
+func (u Unit) String() string {
+	return u.orDefault().Name
+}
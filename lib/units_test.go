@@ -0,0 +1,42 @@
+package lib
+
+import (
+	"testing"
+)
+
+func TestParseUnit(t *testing.T) {
+	expectUnit(t, "bps", 1)
+	expectUnit(t, "Kbps", 1e3)
+	expectUnit(t, "mbps", 1e6)
+	expectUnit(t, "Gbps", 1e9)
+	expectUnit(t, "MBps", 8e6)
+	expectUnit(t, "Mibps", 1<<20)
+	expectUnit(t, "GiBps", 8*(1<<30))
+
+	for _, bad := range []string{"", "M", "Mbit", "Xbps"} {
+		if _, err := ParseUnit(bad); err == nil {
+			t.Errorf("ParseUnit: unit=%q: expected error", bad)
+		}
+	}
+}
+
+func expectUnit(t *testing.T, name string, bits float64) {
+	u, err := ParseUnit(name)
+	if err != nil {
+		t.Errorf("ParseUnit: unit=%q: %v", name, err)
+		return
+	}
+	if u.Bits != bits {
+		t.Errorf("ParseUnit: unit=%q bits=%v wanted=%v", name, u.Bits, bits)
+	}
+}
+
+func TestUnitScale(t *testing.T) {
+	if r := (Unit{}).scale(800000); r != 0.8 {
+		t.Errorf("default unit scale: result=%v wanted=0.8", r)
+	}
+	u, _ := ParseUnit("KBps")
+	if r := u.scale(16000); r != 2 {
+		t.Errorf("KBps scale: result=%v wanted=2", r)
+	}
+}
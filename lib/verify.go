@@ -0,0 +1,156 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"sync"
+)
+
+// With Options.Verify, test data follows a deterministic pattern which the
+// reader checks. TCP streams are checked by blocks of verifyBlockSize bytes
+// at fixed stream offsets, UDP datagrams one by one after the sequence header.
+const verifyBlockSize = 4096
+
+// patternMix spreads the pattern words over all bit positions.
+const patternMix = 0x9e3779b97f4a7c15
+
+// patternByte is the byte expected at position pos of a verified stream.
+// Position pos is the byte pos&7 of the big-endian word (pos>>3)*patternMix.
+func patternByte(pos uint64) byte {
+	return byte(((pos >> 3) * patternMix) >> (56 - 8*(pos&7)))
+}
+
+// patternFill writes the pattern from position pos into b.
+func patternFill(b []byte, pos uint64) {
+	i := 0
+	for ; i < len(b) && (pos+uint64(i))&7 != 0; i++ {
+		b[i] = patternByte(pos + uint64(i))
+	}
+	for ; i+8 <= len(b); i += 8 {
+		binary.BigEndian.PutUint64(b[i:], ((pos+uint64(i))>>3)*patternMix)
+	}
+	for ; i < len(b); i++ {
+		b[i] = patternByte(pos + uint64(i))
+	}
+}
+
+// datagramPos is the pattern position of the payload of datagram seq,
+// so that each datagram carries distinct data.
+func datagramPos(seq uint64) uint64 {
+	return seq << 32
+}
+
+// patternWrite fills every write of f with the pattern. For UDP, it must run
+// after seqWriter, which stamps the sequence number of the datagram.
+func patternWrite(f call, udp bool) call {
+	if udp {
+		return patternDatagrams(f)
+	}
+	return patternWriter(f)
+}
+
+// patternWriter fills every write of f with the pattern of a TCP stream.
+func patternWriter(f call) call {
+	var pos uint64
+	return func(b []byte) (int, error) {
+		patternFill(b, pos)
+		n, err := f(b)
+		if n > 0 {
+			pos += uint64(n)
+		}
+		return n, err
+	}
+}
+
+// patternDatagrams fills the payload of every datagram written by f with the
+// pattern of its sequence number, which seqWriter stamped into the header.
+func patternDatagrams(f call) call {
+	return func(b []byte) (int, error) {
+		if len(b) > seqHeaderLen {
+			patternFill(b[seqHeaderLen:], datagramPos(binary.BigEndian.Uint64(b[4:])))
+		}
+		return f(b)
+	}
+}
+
+// verifyReader checks every read of f with v.
+func verifyReader(f call, v *verifier, udp bool) call {
+	return func(b []byte) (int, error) {
+		n, err := f(b)
+		if n > 0 {
+			if udp {
+				v.datagram(b[:n])
+			} else {
+				v.stream(b[:n])
+			}
+		}
+		return n, err
+	}
+}
+
+// verifier counts the blocks received and those not matching the pattern.
+type verifier struct {
+	mutex     sync.Mutex
+	pos       uint64 // stream position
+	lastBad   uint64 // last corrupted stream block + 1, 0 when none
+	blocks    int64  // datagrams checked
+	corrupted int64
+	expected  []byte // scratch buffer for the pattern
+}
+
+// expect returns the pattern of size bytes from position pos.
+func (v *verifier) expect(size int, pos uint64) []byte {
+	if cap(v.expected) < size {
+		v.expected = make([]byte, size)
+	}
+	e := v.expected[:size]
+	patternFill(e, pos)
+	return e
+}
+
+// stream checks the next bytes of a TCP stream, block by block.
+func (v *verifier) stream(b []byte) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	for len(b) > 0 {
+		block := v.pos / verifyBlockSize
+		size := int((block+1)*verifyBlockSize - v.pos) // up to the block end
+		if size > len(b) {
+			size = len(b)
+		}
+		if !bytes.Equal(b[:size], v.expect(size, v.pos)) && block+1 != v.lastBad {
+			v.lastBad = block + 1
+			v.corrupted++
+		}
+		v.pos += uint64(size)
+		b = b[size:]
+	}
+}
+
+// datagram checks one UDP datagram.
+func (v *verifier) datagram(b []byte) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+
+	v.blocks++
+
+	if !stamped(b) {
+		v.corrupted++
+		return
+	}
+	payload := b[seqHeaderLen:]
+	if !bytes.Equal(payload, v.expect(len(payload), datagramPos(binary.BigEndian.Uint64(b[4:])))) {
+		v.corrupted++
+	}
+}
+
+// result returns the blocks checked and the corrupted blocks.
+func (v *verifier) result() (blocks, corrupted int64) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	if v.blocks > 0 {
+		return v.blocks, v.corrupted
+	}
+	return int64((v.pos + verifyBlockSize - 1) / verifyBlockSize), v.corrupted
+}
@@ -0,0 +1,59 @@
+package lib
+
+import (
+	"encoding/binary"
+	"testing"
+)
+
+func TestPatternFill(t *testing.T) {
+	for _, pos := range []uint64{0, 3, 8, 4093, 1 << 40} {
+		b := make([]byte, 37)
+		patternFill(b, pos)
+		for i, c := range b {
+			if c != patternByte(pos+uint64(i)) {
+				t.Fatalf("patternFill: pos=%d: byte %d mismatch", pos, i)
+			}
+		}
+	}
+}
+
+func TestVerifierStream(t *testing.T) {
+	data := make([]byte, 5*verifyBlockSize)
+	patternFill(data, 0)
+
+	data[100]++                 // block 0
+	data[200]++                 // block 0 again
+	data[3*verifyBlockSize+1]++ // block 3
+
+	var v verifier
+	for b := data; len(b) > 0; {
+		n := 1000 // reads not aligned to blocks
+		if n > len(b) {
+			n = len(b)
+		}
+		v.stream(b[:n])
+		b = b[n:]
+	}
+
+	blocks, corrupted := v.result()
+	if blocks != 5 || corrupted != 2 {
+		t.Errorf("verifier: expected 2/5 corrupted blocks, got %d/%d", corrupted, blocks)
+	}
+}
+
+func TestVerifierDatagram(t *testing.T) {
+	d := make([]byte, 100)
+	binary.BigEndian.PutUint32(d, seqMagic)
+	binary.BigEndian.PutUint64(d[4:], 7)
+	patternFill(d[seqHeaderLen:], datagramPos(7))
+
+	var v verifier
+	v.datagram(d)
+	d[50]++
+	v.datagram(d)
+
+	blocks, corrupted := v.result()
+	if blocks != 2 || corrupted != 1 {
+		t.Errorf("verifier: expected 1/2 corrupted datagrams, got %d/%d", corrupted, blocks)
+	}
+}
@@ -0,0 +1,185 @@
+package lib
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"io"
+)
+
+// Wire formats for handshake messages, see PROTOCOL.md.
+const (
+	WireGob  = "gob"  // Go encoding/gob, the legacy format
+	WireJSON = "json" // length-prefixed JSON frames
+)
+
+// jsonMagic starts every JSON frame. A gob stream never starts with it,
+// which lets the server detect the format of the first message.
+const jsonMagic = "GOBN"
+
+// frameHeaderSize is the magic followed by the big-endian JSON length.
+const frameHeaderSize = len(jsonMagic) + 4
+
+// maxFrameSize bounds the JSON length accepted from a peer.
+const maxFrameSize = 1 << 20
+
+// wire encodes handshake messages on one connection or UDP remote.
+type wire struct {
+	json bool // framed JSON, otherwise gob
+	udp  bool // one message per datagram
+}
+
+func newWire(format string, udp bool) wire {
+	return wire{json: format == WireJSON, udp: udp}
+}
+
+func (w wire) String() string {
+	if w.json {
+		return WireJSON
+	}
+	return WireGob
+}
+
+// send encodes a handshake message, as one datagram for UDP.
+func (w wire) send(conn io.Writer, v interface{}) error {
+	if w.json {
+		frame, errFrame := jsonFrame(v)
+		if errFrame != nil {
+			return errFrame
+		}
+		if _, errWrite := conn.Write(frame); errWrite != nil {
+			return fmt.Errorf("%s write: %v", w.proto(), errWrite)
+		}
+		return nil
+	}
+
+	if w.udp {
+		var buf bytes.Buffer
+		enc := gob.NewEncoder(&buf)
+		if errEnc := enc.Encode(v); errEnc != nil {
+			return fmt.Errorf("UDP encoding: %v", errEnc)
+		}
+		if _, errWrite := conn.Write(buf.Bytes()); errWrite != nil {
+			return fmt.Errorf("UDP write: %v", errWrite)
+		}
+		return nil
+	}
+
+	enc := gob.NewEncoder(conn)
+	if errEnc := enc.Encode(v); errEnc != nil {
+		return fmt.Errorf("TCP failure: %v", errEnc)
+	}
+
+	return nil
+}
+
+// recv decodes a handshake message sent by send.
+func (w wire) recv(conn io.Reader, v interface{}) error {
+	if w.udp {
+		buf := make([]byte, 65536)
+		n, errRead := conn.Read(buf)
+		if errRead != nil {
+			return fmt.Errorf("UDP read: %v", errRead)
+		}
+		return w.decode(buf[:n], v)
+	}
+
+	if w.json {
+		var header [frameHeaderSize]byte
+		if _, errRead := io.ReadFull(conn, header[:]); errRead != nil {
+			return fmt.Errorf("TCP failure: %v", errRead)
+		}
+		size, errHeader := frameSize(header[:])
+		if errHeader != nil {
+			return errHeader
+		}
+		body := make([]byte, size)
+		if _, errRead := io.ReadFull(conn, body); errRead != nil {
+			return fmt.Errorf("TCP failure: %v", errRead)
+		}
+		if errDec := json.Unmarshal(body, v); errDec != nil {
+			return fmt.Errorf("JSON decoding: %v", errDec)
+		}
+		return nil
+	}
+
+	dec := gob.NewDecoder(exactReader{conn})
+	if errDec := dec.Decode(v); errDec != nil {
+		return fmt.Errorf("TCP failure: %v", errDec)
+	}
+
+	return nil
+}
+
+// decode decodes a handshake message from a UDP datagram.
+func (w wire) decode(datagram []byte, v interface{}) error {
+	if w.json {
+		if len(datagram) < frameHeaderSize {
+			return fmt.Errorf("UDP decoding: short frame: %d bytes", len(datagram))
+		}
+		size, errHeader := frameSize(datagram[:frameHeaderSize])
+		if errHeader != nil {
+			return errHeader
+		}
+		body := datagram[frameHeaderSize:]
+		if len(body) != size {
+			return fmt.Errorf("UDP decoding: frame length %d, datagram holds %d bytes", size, len(body))
+		}
+		if errDec := json.Unmarshal(body, v); errDec != nil {
+			return fmt.Errorf("JSON decoding: %v", errDec)
+		}
+		return nil
+	}
+
+	dec := gob.NewDecoder(bytes.NewBuffer(datagram))
+	if errDec := dec.Decode(v); errDec != nil {
+		return fmt.Errorf("UDP decoding: %v", errDec)
+	}
+	return nil
+}
+
+func (w wire) proto() string {
+	if w.udp {
+		return "UDP"
+	}
+	return "TCP"
+}
+
+func jsonFrame(v interface{}) ([]byte, error) {
+	body, errEnc := json.Marshal(v)
+	if errEnc != nil {
+		return nil, fmt.Errorf("JSON encoding: %v", errEnc)
+	}
+	frame := make([]byte, frameHeaderSize, frameHeaderSize+len(body))
+	copy(frame, jsonMagic)
+	binary.BigEndian.PutUint32(frame[len(jsonMagic):], uint32(len(body)))
+	return append(frame, body...), nil
+}
+
+func frameSize(header []byte) (int, error) {
+	if string(header[:len(jsonMagic)]) != jsonMagic {
+		return 0, fmt.Errorf("bad frame magic: expected=[%s] got=[%q]", jsonMagic, header[:len(jsonMagic)])
+	}
+	size := binary.BigEndian.Uint32(header[len(jsonMagic):])
+	if size > maxFrameSize {
+		return 0, fmt.Errorf("frame too large: %d bytes", size)
+	}
+	return int(size), nil
+}
+
+// detectWire tells the wire format from the first bytes sent by a client.
+func detectWire(first []byte, udp bool) wire {
+	return wire{json: bytes.HasPrefix(first, []byte(jsonMagic)), udp: udp}
+}
+
+// peekWire reads enough of a TCP stream to detect the wire format.
+// The returned reader replays the bytes read.
+func peekWire(conn io.Reader) (wire, io.Reader, error) {
+	peek := make([]byte, len(jsonMagic))
+	if _, errRead := io.ReadFull(conn, peek); errRead != nil {
+		return wire{}, nil, errRead
+	}
+	return detectWire(peek, false), io.MultiReader(bytes.NewReader(peek), conn), nil
+}
@@ -0,0 +1,46 @@
+package lib
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestWireRoundTrip(t *testing.T) {
+	sent := Options{TotalDuration: 3 * time.Second, TCPReadSize: 1000, Version: ProtocolVersion, Features: []string{featureOmit}}
+
+	for _, format := range []string{WireGob, WireJSON} {
+		var buf bytes.Buffer
+		if errSend := newWire(format, false).send(&buf, &sent); errSend != nil {
+			t.Fatalf("%s: send: %v", format, errSend)
+		}
+		buf.WriteString("test data")
+
+		w, first, errPeek := peekWire(&buf)
+		if errPeek != nil {
+			t.Fatalf("%s: peek: %v", format, errPeek)
+		}
+		if w.String() != format {
+			t.Errorf("%s: detected as %s", format, w)
+		}
+
+		var received Options
+		if errRecv := w.recv(first, &received); errRecv != nil {
+			t.Fatalf("%s: recv: %v", format, errRecv)
+		}
+		if received.TotalDuration != sent.TotalDuration || received.TCPReadSize != sent.TCPReadSize || len(received.Features) != 1 {
+			t.Errorf("%s: sent %v received %v", format, sent, received)
+		}
+		if buf.String() != "test data" {
+			t.Errorf("%s: handshake consumed test data: remaining %q", format, buf.String())
+		}
+	}
+}
+
+func TestWireFrameTooLarge(t *testing.T) {
+	header := []byte(jsonMagic + "\xff\xff\xff\xff")
+	var a ack
+	if errRecv := newWire(WireJSON, false).recv(bytes.NewReader(header), &a); errRecv == nil {
+		t.Errorf("recv: oversized frame accepted")
+	}
+}
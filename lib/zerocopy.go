@@ -0,0 +1,31 @@
+package lib
+
+import (
+	"log"
+	"net"
+)
+
+// zeroCopyWriter returns the write call of a TCP writer with Options.ZeroCopy,
+// and the function releasing it. It returns a nil call when the connection
+// can not send without copies, and the writer keeps regular writes.
+func zeroCopyWriter(label string, conn net.Conn, buf []byte, opt Options) (call, func()) {
+	if !opt.ZeroCopy {
+		return nil, nil
+	}
+	if opt.Verify {
+		log.Printf("%s: zeroCopy: verified data changes every write, using regular writes", label)
+		return nil, nil
+	}
+	tcp, isTCP := conn.(*net.TCPConn)
+	if !isTCP {
+		log.Printf("%s: zeroCopy: not a plain TCP connection, using regular writes: %v", label, conn.RemoteAddr())
+		return nil, nil
+	}
+	write, release, errZeroCopy := sendfileWriter(tcp, buf)
+	if errZeroCopy != nil {
+		log.Printf("%s: zeroCopy: %v, using regular writes", label, errZeroCopy)
+		return nil, nil
+	}
+	log.Printf("%s: zeroCopy: sending with sendfile: %v", label, conn.RemoteAddr())
+	return write, release
+}
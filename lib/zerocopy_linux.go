@@ -0,0 +1,34 @@
+package lib
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+)
+
+// sendfileWriter sends buf from a temporary file with sendfile(2), which
+// TCPConn.ReadFrom uses for a file behind an io.LimitedReader. Each call
+// sends the first len(b) bytes of the file, the content of b is ignored.
+func sendfileWriter(conn *net.TCPConn, buf []byte) (call, func(), error) {
+	f, errTemp := ioutil.TempFile("", "goben-zerocopy-")
+	if errTemp != nil {
+		return nil, nil, errTemp
+	}
+	os.Remove(f.Name()) // the open file remains usable
+
+	if _, errWrite := f.Write(buf); errWrite != nil {
+		f.Close()
+		return nil, nil, errWrite
+	}
+
+	write := func(b []byte) (int, error) {
+		if _, errSeek := f.Seek(0, io.SeekStart); errSeek != nil {
+			return 0, errSeek
+		}
+		n, errSend := conn.ReadFrom(&io.LimitedReader{R: f, N: int64(len(b))})
+		return int(n), errSend
+	}
+
+	return write, func() { f.Close() }, nil
+}
@@ -0,0 +1,52 @@
+package lib
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func TestSendfileWriter(t *testing.T) {
+	listener, errListen := net.Listen("tcp", "127.0.0.1:0")
+	if errListen != nil {
+		t.Fatalf("listen: %v", errListen)
+	}
+	defer listener.Close()
+
+	received := make(chan []byte, 1)
+	go func() {
+		conn, errAccept := listener.Accept()
+		if errAccept != nil {
+			received <- nil
+			return
+		}
+		data, _ := ioutil.ReadAll(conn)
+		conn.Close()
+		received <- data
+	}()
+
+	conn, errDial := net.Dial("tcp", listener.Addr().String())
+	if errDial != nil {
+		t.Fatalf("dial: %v", errDial)
+	}
+
+	buf := []byte("0123456789")
+	write, release, errWriter := sendfileWriter(conn.(*net.TCPConn), buf)
+	if errWriter != nil {
+		t.Fatalf("sendfileWriter: %v", errWriter)
+	}
+	defer release()
+
+	for _, size := range []int{10, 4} {
+		if n, errWrite := write(make([]byte, size)); n != size || errWrite != nil {
+			t.Fatalf("write %d bytes: n=%d: %v", size, n, errWrite)
+		}
+	}
+	conn.(*net.TCPConn).CloseWrite()
+
+	if data := <-received; !bytes.Equal(data, []byte("01234567890123")) {
+		t.Errorf("sendfileWriter: received %q", data)
+	}
+	conn.Close()
+}
@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package lib
+
+import (
+	"errors"
+	"net"
+)
+
+func sendfileWriter(conn *net.TCPConn, buf []byte) (call, func(), error) {
+	return nil, nil, errors.New("sendfile path only available on Linux")
+}